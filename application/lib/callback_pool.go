@@ -0,0 +1,162 @@
+package lib
+
+const (
+	// defaultCallbackWorkers is the number of goroutines running non-critical
+	// registration callbacks.
+	defaultCallbackWorkers = 4
+
+	// defaultCallbackQueue is the number of callbacks that may wait for a worker
+	// before new callbacks are dropped.
+	defaultCallbackQueue = 1024
+)
+
+// RegistrationObserver is notified of registration events after they happen. Observers
+// can not influence the registration and are run asynchronously on a bounded worker
+// pool, so a slow observer never delays registration handling. If the pool falls too
+// far behind notifications are dropped and counted in the station stats.
+type RegistrationObserver func(event RegistrationEvent, reg *DecoyRegistration)
+
+// RegistrationHook is called synchronously when a registration is added or expires.
+// See OnRegister and OnExpire.
+type RegistrationHook func(reg *DecoyRegistration)
+
+// callbackPool runs non-critical callbacks on a fixed number of workers fed by a
+// bounded queue.
+type callbackPool struct {
+	queue chan func()
+}
+
+func newCallbackPool(workers, queueLen int) *callbackPool {
+	p := &callbackPool{
+		queue: make(chan func(), queueLen),
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *callbackPool) work() {
+	for f := range p.queue {
+		f()
+	}
+}
+
+// submit queues f to be run by a worker without blocking. If the queue is full f is
+// dropped and false is returned.
+func (p *callbackPool) submit(f func()) bool {
+	select {
+	case p.queue <- f:
+		return true
+	default:
+		Stat().AddDroppedCallback()
+		return false
+	}
+}
+
+// AddObserver registers an observer to be notified of registration events. Observers
+// should be added before registrations are received.
+func (regManager *RegistrationManager) AddObserver(o RegistrationObserver) {
+	regManager.observerMutex.Lock()
+	defer regManager.observerMutex.Unlock()
+
+	regManager.observers = append(regManager.observers, o)
+}
+
+// notifyObservers queues a notification of event for reg to every observer. Each
+// observer is passed its own copy of reg, taken before the notification is queued, so
+// observers never race with updates to the tracked registration. It must not be
+// called while holding the registration lock.
+func (regManager *RegistrationManager) notifyObservers(event RegistrationEvent, reg *DecoyRegistration) {
+	if reg.selfTest {
+		return
+	}
+
+	regManager.observerMutex.RLock()
+	observers := regManager.observers
+	regManager.observerMutex.RUnlock()
+
+	if len(observers) == 0 {
+		return
+	}
+
+	regManager.callbackOnce.Do(func() {
+		if regManager.callbacks == nil {
+			regManager.callbacks = newCallbackPool(defaultCallbackWorkers, defaultCallbackQueue)
+		}
+	})
+
+	for _, o := range observers {
+		o := o
+		regCopy := regManager.registeredDecoys.copyRegistration(reg)
+		regManager.callbacks.submit(func() { o(event, regCopy) })
+	}
+}
+
+// copyRegistration returns a copy of reg taken under the registration lock.
+func (r *RegisteredDecoys) copyRegistration(reg *DecoyRegistration) *DecoyRegistration {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	regCopy := *reg
+	return &regCopy
+}
+
+// OnRegister adds a hook called each time a new registration is added with
+// AddRegistration. Unlike observers, hooks run synchronously on the goroutine adding
+// the registration, after it is tracked and published to the detector and before
+// AddRegistration returns, so a slow hook delays registration handling. Hooks are
+// called in the order they were added, without the registration lock held so they
+// may call back into the manager. Each hook is passed its own copy of the
+// registration. Repeats of a registration that is already valid do not call the
+// hooks. Hooks should be added before registrations are received.
+func (regManager *RegistrationManager) OnRegister(hook RegistrationHook) {
+	regManager.observerMutex.Lock()
+	defer regManager.observerMutex.Unlock()
+
+	regManager.registerHooks = append(regManager.registerHooks, hook)
+}
+
+// OnExpire adds a hook called for each registration removed by
+// RemoveOldRegistrations. The hooks run synchronously once the whole batch of expired
+// registrations has been removed, in the order the registrations were removed and,
+// for each registration, in the order the hooks were added. Each hook is passed its
+// own copy of the registration. The registration lock is not held so hooks may call
+// back into the manager.
+func (regManager *RegistrationManager) OnExpire(hook RegistrationHook) {
+	regManager.observerMutex.Lock()
+	defer regManager.observerMutex.Unlock()
+
+	regManager.expireHooks = append(regManager.expireHooks, hook)
+}
+
+// notifyExpired runs the expire hooks and notifies observers for a registration
+// that has been removed from the registration table.
+func (regManager *RegistrationManager) notifyExpired(reg *DecoyRegistration) {
+	regManager.runHooks(EventExpire, reg)
+	regManager.notifyObservers(EventExpire, reg)
+}
+
+// runHooks calls the hooks for event with a copy of reg. The self-test registration
+// is internal to the station and never passed to hooks. It must not be called while
+// holding the registration lock.
+func (regManager *RegistrationManager) runHooks(event RegistrationEvent, reg *DecoyRegistration) {
+	if reg.selfTest {
+		return
+	}
+
+	regManager.observerMutex.RLock()
+	var hooks []RegistrationHook
+	switch event {
+	case EventRegister:
+		hooks = regManager.registerHooks
+	case EventExpire:
+		hooks = regManager.expireHooks
+	}
+	regManager.observerMutex.RUnlock()
+
+	for _, hook := range hooks {
+		hook(regManager.registeredDecoys.copyRegistration(reg))
+	}
+}
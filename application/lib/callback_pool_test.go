@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbackPoolSlowObserver(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	const regs = 8
+	observed := make(chan *DecoyRegistration, regs)
+	rm.AddObserver(func(event RegistrationEvent, reg *DecoyRegistration) {
+		time.Sleep(500 * time.Millisecond)
+		if event == EventRegister {
+			observed <- reg
+		}
+	})
+
+	start := time.Now()
+	for i := 0; i < regs; i++ {
+		require.Nil(t, rm.AddRegistration(&DecoyRegistration{
+			DarkDecoy: net.ParseIP(fmt.Sprintf("192.0.2.%d", i+1)),
+			Keys:      &ConjureSharedKeys{SharedSecret: []byte(fmt.Sprintf("%d slow observer", i))},
+		}))
+	}
+	require.True(t, time.Since(start) < 250*time.Millisecond, "registration blocked on observer")
+
+	// Every registration is still observed.
+	for i := 0; i < regs; i++ {
+		select {
+		case <-observed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("observed %d of %d registrations", i, regs)
+		}
+	}
+}
+
+func TestObserversReceiveCopies(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	observed := make(chan *DecoyRegistration, 2)
+	for i := 0; i < 2; i++ {
+		rm.AddObserver(func(event RegistrationEvent, reg *DecoyRegistration) {
+			reg.Covert = "observer was here"
+			observed <- reg
+		})
+	}
+
+	reg := &DecoyRegistration{
+		DarkDecoy: net.ParseIP("192.0.2.1"),
+		Keys:      &ConjureSharedKeys{SharedSecret: []byte("observer copies")},
+		Covert:    "192.0.2.99:443",
+	}
+	require.Nil(t, rm.AddRegistration(reg))
+
+	var copies []*DecoyRegistration
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-observed:
+			copies = append(copies, c)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("observed %d of 2 notifications", i)
+		}
+	}
+
+	// Each observer gets its own copy and can not modify the tracked registration.
+	require.True(t, copies[0] != reg && copies[1] != reg && copies[0] != copies[1])
+	require.True(t, reg.DarkDecoy.Equal(copies[0].DarkDecoy))
+	require.Equal(t, "192.0.2.99:443", reg.Covert)
+	require.Equal(t, "192.0.2.99:443", rm.GetRegistrations(reg.DarkDecoy)[mockTransport{}.GetIdentifier(reg)].Covert)
+}
+
+func TestCallbackPoolDropsWhenFull(t *testing.T) {
+	pool := newCallbackPool(1, 1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	require.True(t, pool.submit(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+
+	// The worker is busy so one callback can wait, the next is dropped.
+	var ran int32
+	dropped := atomic.LoadInt64(&Stat().droppedCallbacks)
+	require.True(t, pool.submit(func() { atomic.AddInt32(&ran, 1) }))
+	require.False(t, pool.submit(func() { atomic.AddInt32(&ran, 1) }))
+	require.Equal(t, dropped+1, atomic.LoadInt64(&Stat().droppedCallbacks))
+
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&ran))
+}
+
+func TestRegistrationHooks(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	var calls []string
+	var hookRegs []*DecoyRegistration
+	rm.OnRegister(func(reg *DecoyRegistration) { hookRegs = append(hookRegs, reg) })
+	for _, name := range []string{"first", "second"} {
+		name := name
+		rm.OnRegister(func(reg *DecoyRegistration) {
+			// Hooks may call back into the manager.
+			require.NotNil(t, rm.registeredDecoys.RegistrationExists(reg))
+			calls = append(calls, fmt.Sprintf("%s register %s", name, reg.DarkDecoy))
+		})
+		rm.OnExpire(func(reg *DecoyRegistration) {
+			require.Nil(t, rm.registeredDecoys.RegistrationExists(reg))
+			calls = append(calls, fmt.Sprintf("%s expire %s", name, reg.DarkDecoy))
+		})
+	}
+
+	var regs []*DecoyRegistration
+	for i := 0; i < 4; i++ {
+		reg := &DecoyRegistration{
+			DarkDecoy: net.ParseIP(fmt.Sprintf("192.0.2.%d", i+1)),
+			Keys:      &ConjureSharedKeys{SharedSecret: []byte(fmt.Sprintf("%d hooks", i))},
+		}
+		require.Nil(t, rm.AddRegistration(reg))
+		regs = append(regs, reg)
+	}
+
+	// Repeats of a valid registration do not call the register hooks again.
+	require.Nil(t, rm.AddRegistration(regs[0]))
+
+	// Hooks are passed copies of the registrations.
+	require.Equal(t, len(regs), len(hookRegs))
+	for i, reg := range hookRegs {
+		require.True(t, reg != regs[i])
+		require.True(t, reg.DarkDecoy.Equal(regs[i].DarkDecoy))
+	}
+
+	require.Equal(t, []string{
+		"first register 192.0.2.1", "second register 192.0.2.1",
+		"first register 192.0.2.2", "second register 192.0.2.2",
+		"first register 192.0.2.3", "second register 192.0.2.3",
+		"first register 192.0.2.4", "second register 192.0.2.4",
+	}, calls)
+
+	// The expire hooks receive exactly the registrations that were removed.
+	calls = nil
+	for _, reg := range regs[1:3] {
+		index := reg.IDString() + reg.DarkDecoy.String()
+		timeout := rm.registeredDecoys.decoysTimeouts[index]
+		rm.registeredDecoys.dropTimeout(index)
+		timeout.registrationTime = time.Now().Add(-7 * time.Hour)
+		rm.registeredDecoys.addTimeout(timeout)
+	}
+	rm.RemoveOldRegistrations()
+
+	require.Equal(t, 4, len(calls))
+	expired := map[string]bool{}
+	for i := 0; i < len(calls); i += 2 {
+		// Each registration is passed to every hook, in the order they were added.
+		var first, second string
+		_, err := fmt.Sscanf(calls[i], "first expire %s", &first)
+		require.Nil(t, err)
+		_, err = fmt.Sscanf(calls[i+1], "second expire %s", &second)
+		require.Nil(t, err)
+		require.Equal(t, first, second)
+		expired[first] = true
+	}
+	require.Equal(t, map[string]bool{"192.0.2.2": true, "192.0.2.3": true}, expired)
+	require.Equal(t, 2, rm.TotalRegistrations())
+}
@@ -13,6 +13,9 @@ import (
 type Config struct {
 	ZMQConfig
 
+	// Redis server used to share registrations with the detector.
+	RedisConfig
+
 	// Bool to enable or disable sharing of registrations over API when received over decoy registrar
 	EnableShareOverAPI bool `toml:"enable_share_over_api"`
 
@@ -34,6 +37,101 @@ type Config struct {
 	// Local list of disallowed subnets patterns for phantom addresses.
 	PhantomBlocklist []string `toml:"phantom_blocklist"`
 	phantomBlocklist []*net.IPNet
+
+	// Subnets of registration sources (e.g. internal health checks) that are exempt
+	// from rate and capacity limits.
+	TrustedSourceSubnets []string `toml:"trusted_source_subnets"`
+
+	// Maximum number of registrations tracked at once. New registrations are rejected
+	// while the limit is reached. 0 disables the limit.
+	MaxTrackedRegistrations int `toml:"max_tracked_registrations"`
+
+	// Registrations accepted per minute from each client address, with bursts of up
+	// to RegistrationRateBurst (defaults to the rate). 0 disables the limit.
+	RegistrationRateLimit int `toml:"registration_rate_limit"`
+	RegistrationRateBurst int `toml:"registration_rate_burst"`
+
+	// Encoding used when sharing registrations with the detector: "binary" (default,
+	// protobuf StationToDetector) or "json".
+	DetectorEncoding string `toml:"detector_encoding"`
+
+	// File to append registration events to for the detector to tail instead of
+	// publishing them over redis. Redis is used if empty.
+	DetectorEventFile string `toml:"detector_event_file"`
+
+	// Only publish registrations to the detector once a liveness probe confirms the
+	// phantom is not in use, even for registrations pre-scanned by the registrar.
+	DeferDetectorPublish bool `toml:"defer_detector_publish"`
+
+	// Coalesce the expiry events from each eviction tick into a single message to the
+	// detector when the detector publisher supports it.
+	BatchExpiryNotifications bool `toml:"batch_expiry_notifications"`
+
+	// Serialization used for registrations written outside of the station: "gob"
+	// (default), "json" or "protobuf".
+	RegistrationCodec string `toml:"registration_codec"`
+
+	// Path to a file holding a raw 16, 24 or 32 byte AES key used to encrypt
+	// registrations written outside of the station. Stored in plaintext if empty.
+	RegistrationKeyPath string `toml:"registration_key_path"`
+
+	// File the registration table is periodically saved to and restored from on
+	// startup. Disabled if empty.
+	RegistrationSnapshotPath string `toml:"registration_snapshot_path"`
+
+	// Time in milliseconds between registration snapshots. Defaults to one minute.
+	RegistrationSnapshotInterval int `toml:"registration_snapshot_interval"`
+
+	// How to handle registrations where the client's advertised v6 support is
+	// inconsistent with the rest of the registration: "require_consistent" (default)
+	// or "honor".
+	V6SupportPolicy string `toml:"v6_support_policy"`
+
+	// Minimum time in milliseconds between liveness probes sent to a single phantom
+	// address. Uses DefaultLivenessProbeInterval if unset; 0 disables caching.
+	LivenessProbeInterval *int `toml:"liveness_probe_interval"`
+
+	// Time in milliseconds that a live / not live liveness result is reused for a
+	// phantom address. Uses LivenessProbeInterval if unset.
+	LivenessLiveTTL int `toml:"liveness_live_ttl"`
+	LivenessDeadTTL int `toml:"liveness_dead_ttl"`
+
+	// Ports phantoms are probed on for liveness. A phantom that responds on any of
+	// them is live. Uses the phantom port of each registration if unset.
+	LivenessProbePorts []int `toml:"liveness_probe_ports"`
+
+	// Number of concurrent probes sent when testing a phantom for liveness and the
+	// time in milliseconds to wait for a response. Use 4 probes and 750ms if unset.
+	LivenessProbeWidth   int `toml:"liveness_probe_width"`
+	LivenessProbeTimeout int `toml:"liveness_probe_timeout"`
+
+	// Time in milliseconds that registrations are tracked for. Uses 6 hours if unset.
+	RegistrationTimeout int `toml:"registration_timeout"`
+
+	// Time in milliseconds that registrations are tracked for, by transport name
+	// (e.g. "Min", "Obfs4"). Transports not listed use the default timeout.
+	TransportTimeouts map[string]int `toml:"transport_timeouts"`
+
+	// Number of hex characters of the shared secret compared when warning about
+	// colliding registration ids. Uses the logged id length if unset.
+	IDCollisionPrefixLen int `toml:"id_collision_prefix_len"`
+
+	// Path of the Unix domain socket serving full registration digests (including
+	// secrets) for debugging. Disabled if empty.
+	DebugSocketPath string `toml:"debug_socket_path"`
+
+	// Address to serve the gRPC registration ingest service on. Disabled if empty.
+	// Must be a loopback address unless mutual TLS is configured below.
+	RegistrationRPCAddress string `toml:"registration_rpc_address"`
+
+	// Certificate and key the registration ingest service is served with and the CA
+	// client certificates must be signed by. All or none must be set.
+	RegistrationRPCCert     string `toml:"registration_rpc_cert"`
+	RegistrationRPCKey      string `toml:"registration_rpc_key"`
+	RegistrationRPCClientCA string `toml:"registration_rpc_client_ca"`
+
+	// Address to serve Prometheus metrics on at /metrics. Disabled if empty.
+	MetricsAddress string `toml:"metrics_address"`
 }
 
 func ParseConfig() (*Config, error) {
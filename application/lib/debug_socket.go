@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// debugSocketTimeout bounds how long a single debug socket query may take.
+const debugSocketTimeout = 5 * time.Second
+
+// StartDebugSocket serves full registration digests (including shared secrets) over
+// a Unix domain socket at path that is only accessible to the station user. Each
+// connection sends a single line containing a registration id prefix (hex encoded
+// shared secret prefix) and receives the FullDigest of every matching registration,
+// one per line. This is an out-of-band path for deep debugging so that secrets never
+// need to be written to the main logs.
+//
+// The socket is disabled if path is empty, in which case nil is returned. Otherwise
+// the returned Closer stops the socket.
+func StartDebugSocket(path string, regManager *RegistrationManager) (io.Closer, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	// Clean up a stale socket left behind by a previous run, but never remove
+	// anything that is not a socket.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	// Create the socket with owner only permissions rather than restricting them
+	// after it is created, so that it is never connectable by other users.
+	oldMask := syscall.Umask(0177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on debug socket: %v", err)
+	}
+
+	logger := log.New(os.Stdout, "[DEBUG] ", log.Ldate|log.Lmicroseconds)
+	logger.Printf("serving registration digests on %s", path)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleDebugQuery(conn, regManager, logger)
+		}
+	}()
+
+	return ln, nil
+}
+
+func handleDebugQuery(conn net.Conn, regManager *RegistrationManager, logger *log.Logger) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(debugSocketTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	prefix := strings.ToLower(strings.TrimSpace(line))
+	if prefix == "" {
+		fmt.Fprintln(conn, "error: registration id prefix required")
+		return
+	}
+
+	// findByIDPrefix returns copies, so the digests are consistent even if a
+	// registration is updated concurrently.
+	regs := regManager.registeredDecoys.findByIDPrefix(prefix)
+	logger.Printf("debug query for %s matched %d registrations", prefix, len(regs))
+
+	for _, reg := range regs {
+		fmt.Fprintln(conn, reg.FullDigest())
+	}
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugSocketFullDigest(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_Detector
+	reg, err := rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+	require.Nil(t, err)
+	require.Nil(t, rm.TrackRegistration(reg))
+
+	path := filepath.Join(t.TempDir(), "debug.sock")
+	closer, err := StartDebugSocket(path, rm)
+	require.Nil(t, err)
+	defer closer.Close()
+
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, err = fmt.Fprintln(conn, reg.IDString())
+	require.Nil(t, err)
+
+	digest, err := bufio.NewReader(conn).ReadString('\n')
+	require.Nil(t, err)
+	require.Contains(t, digest, hex.EncodeToString(keys.SharedSecret))
+
+	// The secret is not part of the regular log digest.
+	require.NotContains(t, reg.String(), hex.EncodeToString(keys.SharedSecret))
+}
+
+func TestDebugSocketDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "debug.sock")
+
+	closer, err := StartDebugSocket("", nil)
+	require.Nil(t, err)
+	require.Nil(t, closer)
+
+	_, err = net.Dial("unix", path)
+	require.NotNil(t, err)
+}
+
+func TestDebugSocketFindCopies(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_Detector
+	reg, err := rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+	require.Nil(t, err)
+	require.Nil(t, rm.TrackRegistration(reg))
+
+	// Matches are copies, so updating the registration does not change a digest
+	// being written.
+	found := rm.registeredDecoys.findByIDPrefix(reg.IDString())
+	require.Equal(t, 1, len(found))
+	covert := found[0].Covert
+	require.Nil(t, rm.UpdateCovert(keys.SharedSecret, "192.0.2.200:443"))
+	require.Equal(t, covert, found[0].Covert)
+}
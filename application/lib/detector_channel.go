@@ -8,29 +8,86 @@ import (
 	"github.com/go-redis/redis"
 )
 
-var client *redis.Client
-var once sync.Once
+// Default redis connection settings, matching a redis server running alongside the
+// detector on the station host.
+const (
+	defaultRedisAddress  = "localhost:6379"
+	defaultRedisPoolSize = 100
+)
+
+// RedisConfig describes the redis server registrations are shared with the detector
+// through. Zero values select the defaults: the address is read from the
+// CJ_REDIS_ADDRESS environment variable if set and is otherwise localhost:6379, and
+// the pool size is 100.
+//
+// If BatchSize is set registrations are queued and published in pipelined batches
+// of up to BatchSize, waiting at most FlushInterval milliseconds (10 by default) for
+// a batch to fill. See PipelinedRedisPublisher.
+type RedisConfig struct {
+	Address  string `toml:"redis_address"`
+	Password string `toml:"redis_password"`
+	DB       int    `toml:"redis_db"`
+	PoolSize int    `toml:"redis_pool_size"`
+
+	BatchSize     int `toml:"redis_batch_size"`
+	FlushInterval int `toml:"redis_flush_interval"`
+}
+
+func (c RedisConfig) options() *redis.Options {
+	addr := c.Address
+	if addr == "" {
+		addr = os.Getenv("CJ_REDIS_ADDRESS")
+	}
+	if addr == "" {
+		addr = defaultRedisAddress
+	}
+
+	poolSize := c.PoolSize
+	if poolSize <= 0 {
+		poolSize = defaultRedisPoolSize
+	}
+
+	return &redis.Options{
+		Addr:     addr,
+		Password: c.Password,
+		DB:       c.DB,
+		PoolSize: poolSize,
+	}
+}
 
+// redisConn lazily creates a redis client for a RedisConfig.
+//
 // Redis client is already multiplexed and long lived. It is threadsafe so it
 // should be able to be accessed by multiple registration threads concurrently
 // with no issues. PoolSize is tunable in case this ends up being an issue.
-func getRedisClient() *redis.Client {
-	once.Do(initRedisClient)
-	return client
+type redisConn struct {
+	conf   RedisConfig
+	once   sync.Once
+	client *redis.Client
+}
+
+func newRedisConn(conf RedisConfig) *redisConn {
+	return &redisConn{conf: conf}
 }
 
-func initRedisClient() {
-	client = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-		PoolSize: 100,
+func (r *redisConn) get() *redis.Client {
+	r.once.Do(func() {
+		options := r.conf.options()
+		r.client = redis.NewClient(options)
+
+		// Ping to test redis connection
+		_, err := r.client.Ping().Result()
+		if err != nil {
+			logger := log.New(os.Stderr, "[REDIS] ", log.Ldate|log.Lmicroseconds)
+			logger.Printf("redis connection ping to %s failed: %v", options.Addr, err)
+		}
 	})
+	return r.client
+}
 
-	// Ping to test redis connection
-	_, err := client.Ping().Result()
-	if err != nil {
-		logger := log.New(os.Stderr, "[REDIS] ", log.Ldate|log.Lmicroseconds)
-		logger.Printf("redis connection ping failed.")
-	}
+// defaultRedis is used when no redis configuration has been provided.
+var defaultRedis = newRedisConn(RedisConfig{})
+
+func getRedisClient() *redis.Client {
+	return defaultRedis.get()
 }
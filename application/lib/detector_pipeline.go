@@ -0,0 +1,252 @@
+package lib
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// defaultRedisFlushInterval is the longest a registration waits to be published
+	// when fewer than a full batch are queued.
+	defaultRedisFlushInterval = 10 * time.Millisecond
+
+	// detectorQueueLen is the number of registrations that may wait to be published
+	// before new registrations are rejected.
+	detectorQueueLen = 4096
+
+	// Bounds of the delay between attempts to publish a batch while redis is
+	// unavailable.
+	minPublishRetry = 100 * time.Millisecond
+	maxPublishRetry = 10 * time.Second
+)
+
+// ErrDetectorQueueFull is returned when a registration can not be queued for
+// publishing because the queue is full, most likely because redis has been
+// unavailable for some time.
+var ErrDetectorQueueFull = errors.New("detector publish queue is full")
+
+// redisBatchSender publishes many messages to a redis channel in one round trip.
+type redisBatchSender interface {
+	publishAll(channel string, messages [][]byte) error
+}
+
+// publishAll implements redisBatchSender using a redis pipeline.
+func (r *redisConn) publishAll(channel string, messages [][]byte) error {
+	client := r.get()
+	if client == nil {
+		return errors.New("couldn't connect to redis")
+	}
+
+	_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, msg := range messages {
+			pipe.Publish(channel, string(msg))
+		}
+		return nil
+	})
+	return err
+}
+
+// ping implements redisPinger.
+func (r *redisConn) ping() error {
+	client := r.get()
+	if client == nil {
+		return errors.New("couldn't connect to redis")
+	}
+	return client.Ping().Err()
+}
+
+// redisPinger is implemented by redis batch senders able to check the server is
+// reachable.
+type redisPinger interface {
+	ping() error
+}
+
+// PipelinedRedisPublisher publishes registrations to the detector over redis like the
+// default publisher, but queues them to be sent by a background worker that
+// publishes up to a batch of registrations in a single pipelined round trip. A
+// batch is sent once it is full or the flush interval has passed since the first
+// registration in it was queued. If redis is unavailable the batch is retried with
+// exponential backoff while new registrations keep queueing; once the queue is full
+// Publish returns ErrDetectorQueueFull.
+type PipelinedRedisPublisher struct {
+	sender        redisBatchSender
+	batchSize     int
+	flushInterval time.Duration
+	queue         chan []byte
+	logger        *log.Logger
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPipelinedRedisPublisher returns a publisher batching registrations sent to the
+// redis server described by conf, up to conf.BatchSize at a time. The worker runs
+// until Close is called.
+func NewPipelinedRedisPublisher(conf RedisConfig) *PipelinedRedisPublisher {
+	flushInterval := time.Duration(conf.FlushInterval) * time.Millisecond
+	return newPipelinedRedisPublisher(newRedisConn(conf), conf.BatchSize, flushInterval)
+}
+
+func newPipelinedRedisPublisher(sender redisBatchSender, batchSize int, flushInterval time.Duration) *PipelinedRedisPublisher {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultRedisFlushInterval
+	}
+
+	p := &PipelinedRedisPublisher{
+		sender:        sender,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		queue:         make(chan []byte, detectorQueueLen),
+		logger:        log.New(os.Stderr, "[REDIS] ", log.Ldate|log.Lmicroseconds),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish implements DetectorPublisher. Like the default redis publisher expiry
+// events are not sent. A nil error means the registration was queued.
+func (p *PipelinedRedisPublisher) Publish(event RegistrationEvent, encoding DetectorEncoding, payload []byte) error {
+	if event != EventRegister {
+		return nil
+	}
+
+	select {
+	case p.queue <- payload:
+		return nil
+	default:
+		return ErrDetectorQueueFull
+	}
+}
+
+// PublishBatch implements BatchDetectorPublisher by queueing every registration in
+// the batch to be sent by the worker. Registrations are queued until the queue is
+// full, in which case the rest of the batch is dropped and ErrDetectorQueueFull is
+// returned.
+func (p *PipelinedRedisPublisher) PublishBatch(event RegistrationEvent, encoding DetectorEncoding, payloads [][]byte) error {
+	for _, payload := range payloads {
+		if err := p.Publish(event, encoding, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping implements DetectorPinger with a redis PING, without waiting for the
+// registrations already queued.
+func (p *PipelinedRedisPublisher) Ping() error {
+	if pinger, ok := p.sender.(redisPinger); ok {
+		return pinger.ping()
+	}
+	return nil
+}
+
+// Close stops the worker once the registrations already queued have been sent. If
+// redis is unavailable the remaining registrations are attempted once and then
+// dropped.
+func (p *PipelinedRedisPublisher) Close() error {
+	p.closeOnce.Do(func() { close(p.stop) })
+	<-p.done
+	return nil
+}
+
+func (p *PipelinedRedisPublisher) run() {
+	defer close(p.done)
+
+	batch := make([][]byte, 0, p.batchSize)
+	timer := time.NewTimer(p.flushInterval)
+	timer.Stop()
+
+	for {
+		select {
+		case payload := <-p.queue:
+			if len(batch) == 0 {
+				timer.Reset(p.flushInterval)
+			}
+			batch = append(batch, payload)
+			if len(batch) < p.batchSize {
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		case <-p.stop:
+			p.drain(batch)
+			return
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+		if !p.send(batch) {
+			p.drain(batch)
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// send publishes the batch, retrying with backoff until it succeeds. Returns false
+// if the publisher was closed before the batch could be sent.
+func (p *PipelinedRedisPublisher) send(batch [][]byte) bool {
+	retry := minPublishRetry
+	for {
+		err := p.sender.publishAll(DETECTOR_REG_CHANNEL, batch)
+		if err == nil {
+			return true
+		}
+
+		Stat().DetectorPublish(err)
+		p.logger.Printf("failed to publish %d registrations, retrying in %v: %v", len(batch), retry, err)
+
+		select {
+		case <-time.After(retry):
+		case <-p.stop:
+			return false
+		}
+
+		retry *= 2
+		if retry > maxPublishRetry {
+			retry = maxPublishRetry
+		}
+	}
+}
+
+// drain makes a final attempt to publish batch and everything still queued.
+func (p *PipelinedRedisPublisher) drain(batch [][]byte) {
+	for draining := true; draining; {
+		select {
+		case payload := <-p.queue:
+			batch = append(batch, payload)
+		default:
+			draining = false
+		}
+	}
+
+	for len(batch) > 0 {
+		n := p.batchSize
+		if n > len(batch) {
+			n = len(batch)
+		}
+		if err := p.sender.publishAll(DETECTOR_REG_CHANNEL, batch[:n]); err != nil {
+			Stat().DetectorPublish(err)
+			p.logger.Printf("dropping %d registrations that could not be published: %v", len(batch), err)
+			return
+		}
+		batch = batch[n:]
+	}
+}
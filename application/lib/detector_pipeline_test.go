@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis records pipelined publishes, counting the round trips made to send them.
+// The first failures round trips fail as if redis were down.
+type fakeRedis struct {
+	m          sync.Mutex
+	roundTrips int
+	failures   int
+	published  []string
+}
+
+func (f *fakeRedis) publishAll(channel string, messages [][]byte) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.roundTrips++
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("connection refused")
+	}
+	for _, msg := range messages {
+		f.published = append(f.published, string(msg))
+	}
+	return nil
+}
+
+func (f *fakeRedis) counts() (roundTrips, published int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.roundTrips, len(f.published)
+}
+
+// waitPublished waits for n messages to have been published.
+func (f *fakeRedis) waitPublished(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, published := f.counts(); published >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	_, published := f.counts()
+	t.Fatalf("published %d of %d messages", published, n)
+}
+
+func TestPipelinedRedisPublisherBatches(t *testing.T) {
+	fake := &fakeRedis{}
+	p := newPipelinedRedisPublisher(fake, 50, time.Hour)
+
+	for i := 0; i < 200; i++ {
+		require.Nil(t, p.Publish(EventRegister, DetectorEncodingBinary, []byte(fmt.Sprintf("reg %d", i))))
+	}
+	// Expiry events are not sent over redis.
+	require.Nil(t, p.Publish(EventExpire, DetectorEncodingBinary, []byte("expired")))
+
+	fake.waitPublished(t, 200)
+	roundTrips, _ := fake.counts()
+	require.Equal(t, 4, roundTrips)
+
+	// Closing flushes the partial batch.
+	for i := 200; i < 210; i++ {
+		require.Nil(t, p.Publish(EventRegister, DetectorEncodingBinary, []byte(fmt.Sprintf("reg %d", i))))
+	}
+	require.Nil(t, p.Close())
+
+	roundTrips, published := fake.counts()
+	require.Equal(t, 5, roundTrips)
+	require.Equal(t, 210, published)
+	for i, msg := range fake.published {
+		require.Equal(t, fmt.Sprintf("reg %d", i), msg)
+	}
+}
+
+func TestPipelinedRedisPublisherPublishBatch(t *testing.T) {
+	fake := &fakeRedis{}
+	p := newPipelinedRedisPublisher(fake, 4, time.Hour)
+
+	var _ BatchDetectorPublisher = p
+
+	batch := [][]byte{}
+	for i := 0; i < 8; i++ {
+		batch = append(batch, []byte(fmt.Sprintf("reg %d", i)))
+	}
+	require.Nil(t, p.PublishBatch(EventRegister, DetectorEncodingBinary, batch))
+	require.Nil(t, p.PublishBatch(EventExpire, DetectorEncodingBinary, batch))
+
+	// The batch is queued like individual registrations and sent a batch at a time.
+	fake.waitPublished(t, 8)
+	require.Nil(t, p.Close())
+	roundTrips, published := fake.counts()
+	require.Equal(t, 2, roundTrips)
+	require.Equal(t, 8, published)
+}
+
+func TestPipelinedRedisPublisherFlushInterval(t *testing.T) {
+	fake := &fakeRedis{}
+	p := newPipelinedRedisPublisher(fake, 100, 20*time.Millisecond)
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, p.Publish(EventRegister, DetectorEncodingJSON, []byte(fmt.Sprintf("reg %d", i))))
+	}
+
+	// A partial batch is sent once the flush interval passes.
+	fake.waitPublished(t, 3)
+	roundTrips, _ := fake.counts()
+	require.Equal(t, 1, roundTrips)
+}
+
+func TestPipelinedRedisPublisherRetries(t *testing.T) {
+	fake := &fakeRedis{failures: 2}
+	p := newPipelinedRedisPublisher(fake, 5, time.Hour)
+	defer p.Close()
+
+	for i := 0; i < 5; i++ {
+		require.Nil(t, p.Publish(EventRegister, DetectorEncodingBinary, []byte(fmt.Sprintf("reg %d", i))))
+	}
+
+	// The batch is retried rather than dropped while redis is down.
+	fake.waitPublished(t, 5)
+	roundTrips, published := fake.counts()
+	require.Equal(t, 3, roundTrips)
+	require.Equal(t, 5, published)
+}
+
+func TestPipelinedRedisPublisherQueueFull(t *testing.T) {
+	fake := &fakeRedis{failures: 1 << 30}
+	p := newPipelinedRedisPublisher(fake, 1, time.Hour)
+	defer p.Close()
+
+	// With redis down the queue eventually fills and registrations are rejected.
+	var err error
+	for i := 0; i < detectorQueueLen+2 && err == nil; i++ {
+		err = p.Publish(EventRegister, DetectorEncodingBinary, []byte("reg"))
+	}
+	require.Equal(t, ErrDetectorQueueFull, err)
+}
+
+func TestNewRedisPublisherBatchSize(t *testing.T) {
+	p, ok := NewRedisPublisher(RedisConfig{Address: "127.0.0.1:1", BatchSize: 10}).(*PipelinedRedisPublisher)
+	require.True(t, ok)
+	require.Equal(t, 10, p.batchSize)
+	require.Equal(t, defaultRedisFlushInterval, p.flushInterval)
+	require.Nil(t, p.Close())
+}
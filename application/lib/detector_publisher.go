@@ -0,0 +1,224 @@
+package lib
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RegistrationEvent identifies a change to a registration shared with the detector.
+type RegistrationEvent int
+
+const (
+	// EventRegister is published when a registration is validated and should be
+	// tracked by the detector.
+	EventRegister RegistrationEvent = iota
+
+	// EventExpire is published when the station expires a registration.
+	EventExpire
+)
+
+func (e RegistrationEvent) String() string {
+	switch e {
+	case EventRegister:
+		return "register"
+	case EventExpire:
+		return "expire"
+	default:
+		return fmt.Sprintf("event(%d)", int(e))
+	}
+}
+
+// DetectorPublisher shares encoded registration events with the detector.
+type DetectorPublisher interface {
+	Publish(event RegistrationEvent, encoding DetectorEncoding, payload []byte) error
+}
+
+// BatchDetectorPublisher is implemented by publishers able to share many events of
+// the same kind with the detector in a single message.
+type BatchDetectorPublisher interface {
+	DetectorPublisher
+	PublishBatch(event RegistrationEvent, encoding DetectorEncoding, payloads [][]byte) error
+}
+
+// DetectorPinger is implemented by publishers able to check that the detector can be
+// reached without publishing anything. SelfTest uses it to validate the publisher.
+type DetectorPinger interface {
+	Ping() error
+}
+
+// redisPublisher publishes registrations to the detector over redis pub/sub. The
+// detector times registrations out on its own so expiry events are not sent. The
+// default redis connection is used if conn is nil. The connection is created on
+// first use and shared by every later publish.
+type redisPublisher struct {
+	conn *redisConn
+}
+
+// NewRedisPublisher returns a DetectorPublisher sharing registrations with the
+// detector through the redis server described by conf. This is the default
+// publisher; it is only needed to publish to a different server or to wrap the
+// redis publisher in another DetectorPublisher. If conf sets a batch size the
+// registrations are published in batches by a PipelinedRedisPublisher.
+func NewRedisPublisher(conf RedisConfig) DetectorPublisher {
+	if conf.BatchSize > 0 {
+		return NewPipelinedRedisPublisher(conf)
+	}
+	return redisPublisher{conn: newRedisConn(conf)}
+}
+
+func (p redisPublisher) Publish(event RegistrationEvent, encoding DetectorEncoding, payload []byte) error {
+	if event != EventRegister {
+		return nil
+	}
+
+	conn := p.conn
+	if conn == nil {
+		conn = defaultRedis
+	}
+
+	client := conn.get()
+	if client == nil {
+		return fmt.Errorf("couldn't connect to redis")
+	}
+	return client.Publish(DETECTOR_REG_CHANNEL, string(payload)).Err()
+}
+
+// Ping implements DetectorPinger with a redis PING.
+func (p redisPublisher) Ping() error {
+	conn := p.conn
+	if conn == nil {
+		conn = defaultRedis
+	}
+	return conn.ping()
+}
+
+// PublishBatch implements BatchDetectorPublisher, publishing every registration in
+// the batch in a single pipelined round trip.
+func (p redisPublisher) PublishBatch(event RegistrationEvent, encoding DetectorEncoding, payloads [][]byte) error {
+	if event != EventRegister {
+		return nil
+	}
+
+	conn := p.conn
+	if conn == nil {
+		conn = defaultRedis
+	}
+	return conn.publishAll(DETECTOR_REG_CHANNEL, payloads)
+}
+
+// FileEventPublisher appends registration events to a file for a detector running on
+// the same host to tail. Each event is written as a single line of the form
+// "<event> <payload>", where JSON payloads are written as is and binary payloads are
+// base64 encoded. If the file is moved or removed (e.g. by logrotate) it is reopened
+// at path before the next event is written.
+type FileEventPublisher struct {
+	path string
+	f    *os.File
+	m    sync.Mutex
+}
+
+// NewFileEventPublisher opens (creating if necessary) the event file at path. Event
+// payloads include registration secrets, so a newly created file is only readable by
+// the station user.
+func NewFileEventPublisher(path string) (*FileEventPublisher, error) {
+	p := &FileEventPublisher{path: path}
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *FileEventPublisher) open() error {
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open event file: %v", err)
+	}
+	p.f = f
+	return nil
+}
+
+// reopenIfRotated reopens the event file if the path no longer refers to the file
+// currently held open.
+func (p *FileEventPublisher) reopenIfRotated() error {
+	current, err := p.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	onDisk, err := os.Stat(p.path)
+	if err == nil && os.SameFile(current, onDisk) {
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	p.f.Close()
+	return p.open()
+}
+
+// Ping implements DetectorPinger, reopening the event file if it was rotated so
+// that an event file that can no longer be created is reported.
+func (p *FileEventPublisher) Ping() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.reopenIfRotated()
+}
+
+// Publish implements DetectorPublisher.
+func (p *FileEventPublisher) Publish(event RegistrationEvent, encoding DetectorEncoding, payload []byte) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if err := p.reopenIfRotated(); err != nil {
+		return err
+	}
+
+	line := string(payload)
+	if encoding == DetectorEncodingBinary {
+		line = base64.StdEncoding.EncodeToString(payload)
+	}
+
+	_, err := fmt.Fprintf(p.f, "%s %s\n", event, line)
+	return err
+}
+
+// PublishBatch implements BatchDetectorPublisher. The batch is written as a single
+// line of the form "<event>-batch <payloads>", where JSON payloads are written as a
+// JSON array and binary payloads as a comma separated list of base64 strings.
+func (p *FileEventPublisher) PublishBatch(event RegistrationEvent, encoding DetectorEncoding, payloads [][]byte) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if err := p.reopenIfRotated(); err != nil {
+		return err
+	}
+
+	entries := make([]string, len(payloads))
+	for i, payload := range payloads {
+		if encoding == DetectorEncodingBinary {
+			entries[i] = base64.StdEncoding.EncodeToString(payload)
+		} else {
+			entries[i] = string(payload)
+		}
+	}
+
+	line := strings.Join(entries, ",")
+	if encoding != DetectorEncodingBinary {
+		line = "[" + line + "]"
+	}
+
+	_, err := fmt.Fprintf(p.f, "%s-batch %s\n", event, line)
+	return err
+}
+
+// Close closes the event file.
+func (p *FileEventPublisher) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.f.Close()
+}
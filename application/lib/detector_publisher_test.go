@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readEventLines(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestFileEventPublisherRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.log")
+
+	p, err := NewFileEventPublisher(path)
+	require.Nil(t, err)
+	defer p.Close()
+
+	publish := func(event RegistrationEvent, i int) {
+		reg := &DecoyRegistration{
+			DarkDecoy:        net.ParseIP(fmt.Sprintf("192.0.2.%d", i)),
+			registrationAddr: net.ParseIP("198.51.100.1"),
+		}
+		publishForDetector(p, event, reg, DetectorEncodingJSON)
+	}
+
+	publish(EventRegister, 1)
+	publish(EventRegister, 2)
+	publish(EventExpire, 1)
+
+	// Rotate the file out from under the publisher.
+	rotated := filepath.Join(dir, "events.log.1")
+	require.Nil(t, os.Rename(path, rotated))
+
+	// Pinging the publisher reopens the event file.
+	require.Nil(t, p.Ping())
+	_, err = os.Stat(path)
+	require.Nil(t, err)
+
+	publish(EventRegister, 3)
+	publish(EventExpire, 2)
+
+	checkLines := func(lines []string, expected []string) {
+		require.Equal(t, len(expected), len(lines))
+		for i, line := range lines {
+			parts := strings.SplitN(line, " ", 2)
+			require.Equal(t, 2, len(parts))
+
+			var payload detectorJSONPayload
+			require.Nil(t, json.Unmarshal([]byte(parts[1]), &payload))
+			require.Equal(t, expected[i], parts[0]+" "+payload.Phantom)
+		}
+	}
+
+	checkLines(readEventLines(t, rotated), []string{"register 192.0.2.1", "register 192.0.2.2", "expire 192.0.2.1"})
+	checkLines(readEventLines(t, path), []string{"register 192.0.2.3", "expire 192.0.2.2"})
+
+	// Both the original and the reopened file are private to the station user.
+	for _, f := range []string{rotated, path} {
+		info, err := os.Stat(f)
+		require.Nil(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestFileEventPublisherBinary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+
+	p, err := NewFileEventPublisher(path)
+	require.Nil(t, err)
+	defer p.Close()
+
+	require.Nil(t, p.Publish(EventRegister, DetectorEncodingBinary, []byte{0x0a, 0x00, '\n'}))
+
+	lines := readEventLines(t, path)
+	require.Equal(t, []string{"register CgAK"}, lines)
+}
+
+func TestPublishBatchSkipsEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	p, err := NewFileEventPublisher(path)
+	require.Nil(t, err)
+	defer p.Close()
+
+	// Self test registrations are never published, leaving nothing to send.
+	selfTest := &DecoyRegistration{
+		DarkDecoy:        net.ParseIP("192.0.2.1"),
+		registrationAddr: net.ParseIP("198.51.100.1"),
+		selfTest:         true,
+	}
+	publishBatchForDetector(p, EventExpire, []*DecoyRegistration{selfTest}, DetectorEncodingJSON)
+
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), info.Size())
+}
+
+func TestRedisConfigOptions(t *testing.T) {
+	os.Unsetenv("CJ_REDIS_ADDRESS")
+
+	options := RedisConfig{}.options()
+	require.Equal(t, "localhost:6379", options.Addr)
+	require.Equal(t, 100, options.PoolSize)
+	require.Equal(t, 0, options.DB)
+
+	os.Setenv("CJ_REDIS_ADDRESS", "redis.station:6380")
+	defer os.Unsetenv("CJ_REDIS_ADDRESS")
+	require.Equal(t, "redis.station:6380", RedisConfig{}.options().Addr)
+
+	options = RedisConfig{Address: "10.0.0.5:6379", Password: "secret", DB: 2, PoolSize: 10}.options()
+	require.Equal(t, "10.0.0.5:6379", options.Addr)
+	require.Equal(t, "secret", options.Password)
+	require.Equal(t, 2, options.DB)
+	require.Equal(t, 10, options.PoolSize)
+}
+
+func TestRedisPublisherSharesClient(t *testing.T) {
+	publisher := NewRedisPublisher(RedisConfig{Address: "127.0.0.1:1"}).(redisPublisher)
+
+	// Every publish uses the same long lived client rather than dialing its own.
+	client := publisher.conn.get()
+	require.NotNil(t, client)
+	require.True(t, client == publisher.conn.get())
+	require.NotNil(t, publisher.Publish(EventRegister, DetectorEncodingBinary, []byte("payload")))
+	require.True(t, client == publisher.conn.get())
+
+	// Nothing is listening so the ping fails.
+	require.NotNil(t, publisher.Ping())
+
+	// Expiry events are not sent over redis.
+	require.Nil(t, publisher.Publish(EventExpire, DetectorEncodingBinary, []byte("payload")))
+
+	// Batches share the client too.
+	require.NotNil(t, publisher.PublishBatch(EventRegister, DetectorEncodingBinary, [][]byte{[]byte("a"), []byte("b")}))
+	require.True(t, client == publisher.conn.get())
+	require.Nil(t, publisher.PublishBatch(EventExpire, DetectorEncodingBinary, [][]byte{[]byte("a")}))
+
+	// A nil publisher restores the redis default.
+	rm := &RegistrationManager{registeredDecoys: NewRegisteredDecoys()}
+	rm.SetDetectorPublisher(&recordingPublisher{})
+	rm.SetDetectorPublisher(nil)
+	require.Equal(t, redisPublisher{}, rm.registeredDecoys.publisher)
+}
+
+func TestNewRegistrationManagerWithRedis(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+
+	rm, err := NewRegistrationManagerWithRedis(RedisConfig{Address: "10.0.0.5:6379"})
+	require.Nil(t, err)
+	publisher, ok := rm.registeredDecoys.publisher.(redisPublisher)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.5:6379", publisher.conn.conf.Address)
+
+	// Without a config the default redis publisher is used.
+	rm, err = NewRegistrationManager()
+	require.Nil(t, err)
+	require.Equal(t, redisPublisher{}, rm.registeredDecoys.publisher)
+}
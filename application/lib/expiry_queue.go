@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"container/heap"
+	"time"
+)
+
+// timeoutQueue is a min-heap of the timeouts for registrations using a single
+// transport, ordered by registration time. Registrations using the same transport
+// share a timeout so the registrations at the front of the queue expire first.
+type timeoutQueue []*DecoyTimeout
+
+func (q timeoutQueue) Len() int { return len(q) }
+
+func (q timeoutQueue) Less(i, j int) bool {
+	return q[i].registrationTime.Before(q[j].registrationTime)
+}
+
+func (q timeoutQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].queueIndex = i
+	q[j].queueIndex = j
+}
+
+func (q *timeoutQueue) Push(x interface{}) {
+	timeout := x.(*DecoyTimeout)
+	timeout.queueIndex = len(*q)
+	*q = append(*q, timeout)
+}
+
+func (q *timeoutQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	timeout := old[n-1]
+	old[n-1] = nil
+	timeout.queueIndex = -1
+	*q = old[:n-1]
+	return timeout
+}
+
+// registeredBefore appends the index of every timeout in the queue registered
+// before cutoff to indices. Only the matching timeouts and their direct children
+// are visited, so the cost is proportional to the number of expired registrations
+// rather than the size of the queue.
+func (q timeoutQueue) registeredBefore(cutoff time.Time, indices []string) []string {
+	if len(q) == 0 {
+		return indices
+	}
+
+	stack := []int{0}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if !q[i].registrationTime.Before(cutoff) {
+			// Nothing below this entry was registered earlier.
+			continue
+		}
+		indices = append(indices, q[i].index)
+
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(q) {
+				stack = append(stack, child)
+			}
+		}
+	}
+	return indices
+}
+
+// addTimeout starts tracking the expiry of a registration. Must be called with the
+// lock held.
+func (r *RegisteredDecoys) addTimeout(timeout *DecoyTimeout) {
+	if existing, ok := r.decoysTimeouts[timeout.index]; ok {
+		r.dropTimeout(existing.index)
+	}
+
+	queue, ok := r.expiryQueues[timeout.transport]
+	if !ok {
+		queue = &timeoutQueue{}
+		r.expiryQueues[timeout.transport] = queue
+	}
+
+	r.decoysTimeouts[timeout.index] = timeout
+	heap.Push(queue, timeout)
+}
+
+// dropTimeout stops tracking the expiry of the registration with the given timeout
+// index. Must be called with the lock held.
+func (r *RegisteredDecoys) dropTimeout(index string) {
+	timeout, ok := r.decoysTimeouts[index]
+	if !ok {
+		return
+	}
+	delete(r.decoysTimeouts, index)
+
+	queue, ok := r.expiryQueues[timeout.transport]
+	if !ok || timeout.queueIndex < 0 || timeout.queueIndex >= queue.Len() {
+		return
+	}
+	heap.Remove(queue, timeout.queueIndex)
+	if queue.Len() == 0 {
+		delete(r.expiryQueues, timeout.transport)
+	}
+}
+
+// refreshTimeout restarts the timeout of the registration with the given timeout
+// index as if it had just been received. Must be called with the lock held.
+func (r *RegisteredDecoys) refreshTimeout(index string) {
+	timeout, ok := r.decoysTimeouts[index]
+	if !ok {
+		return
+	}
+	timeout.registrationTime = time.Now()
+
+	if queue, ok := r.expiryQueues[timeout.transport]; ok && timeout.queueIndex >= 0 && timeout.queueIndex < queue.Len() {
+		heap.Fix(queue, timeout.queueIndex)
+	}
+}
+
+// expiredTimeouts returns the timeout index of every registration that expired
+// before now. Must be called with the lock held.
+func (r *RegisteredDecoys) expiredTimeouts(now time.Time, defaultTimeout time.Duration) []string {
+	indices := []string{}
+	for transport, queue := range r.expiryQueues {
+		indices = queue.registeredBefore(now.Add(-r.timeoutFor(transport, defaultTimeout)), indices)
+	}
+	return indices
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiryQueueRegisteredBefore(t *testing.T) {
+	r := NewRegisteredDecoys()
+
+	now := time.Now()
+	var want []string
+	for i := 0; i < 200; i++ {
+		index := fmt.Sprintf("timeout %d", i)
+		age := time.Duration(rand.Intn(600)) * time.Second
+		r.addTimeout(&DecoyTimeout{index: index, registrationTime: now.Add(-age)})
+		if age > 5*time.Minute {
+			want = append(want, index)
+		}
+	}
+
+	// Drop a few to make sure removal keeps the heap ordered.
+	for i := 0; i < 200; i += 7 {
+		r.dropTimeout(fmt.Sprintf("timeout %d", i))
+	}
+	var remaining []string
+	for _, index := range want {
+		if _, ok := r.decoysTimeouts[index]; ok {
+			remaining = append(remaining, index)
+		}
+	}
+
+	got := (*r.expiryQueues[0]).registeredBefore(now.Add(-5*time.Minute), nil)
+	sort.Strings(got)
+	sort.Strings(remaining)
+	require.Equal(t, remaining, got)
+}
+
+func TestExpiryQueueReRegistrationRefreshes(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	var regs []*DecoyRegistration
+	for i := 0; i < 3; i++ {
+		reg := &DecoyRegistration{
+			DarkDecoy: net.ParseIP(fmt.Sprintf("192.0.2.%d", i+1)),
+			Keys:      &ConjureSharedKeys{SharedSecret: []byte(fmt.Sprintf("%d expiry queue", i))},
+		}
+		require.Nil(t, rm.TrackRegistration(reg))
+		regs = append(regs, reg)
+	}
+
+	for _, timeout := range rm.registeredDecoys.decoysTimeouts {
+		timeout.registrationTime = time.Now().Add(-7 * time.Hour)
+	}
+
+	// Receiving a registration again restarts its timeout rather than adding a
+	// second entry.
+	require.Nil(t, rm.TrackRegistration(regs[1]))
+	require.Equal(t, int32(2), regs[1].regCount)
+	require.Equal(t, 3, len(rm.registeredDecoys.decoysTimeouts))
+	require.Equal(t, 3, rm.registeredDecoys.expiryQueues[0].Len())
+
+	removed := rm.registeredDecoys.removeOldRegistrations(rm.Logger, 0)
+	require.Equal(t, 2, len(removed))
+	require.True(t, rm.RegistrationExists(regs[1]))
+	require.Equal(t, 1, len(rm.registeredDecoys.decoysTimeouts))
+	require.Equal(t, 1, rm.registeredDecoys.expiryQueues[0].Len())
+}
@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxConcurrentProbes limits the number of liveness probes in flight at once across
+// the station.
+const maxConcurrentProbes = 64
+
+var probeSlots = make(chan struct{}, maxConcurrentProbes)
+
+// defaultProbePort is the port phantoms are probed on when neither the station nor
+// the registration specifies one.
+const defaultProbePort = 443
+
+// Default number of concurrent probes sent to a phantom and how long to wait for any
+// of them to get a response.
+const (
+	defaultProbeWidth   = 4
+	defaultProbeTimeout = 750 * time.Millisecond
+)
+
+// LivenessResult is the outcome of probing a single phantom address.
+type LivenessResult struct {
+	Live bool
+	Err  error
+}
+
+// probeWithContext runs a single liveness probe of one or more addresses (host:port)
+// for a phantom once a slot is available under the global probe concurrency limit,
+// giving up if ctx is done first.
+func probeWithContext(ctx context.Context, addresses []string, dial livenessContextDialer, width int, timeout time.Duration) (bool, error) {
+	select {
+	case probeSlots <- struct{}{}:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	defer func() { <-probeSlots }()
+
+	return phantomIsLiveDialContext(ctx, addresses, dial, width, timeout)
+}
+
+// ProbeMany probes the liveness of many phantom addresses (host:port) concurrently,
+// subject to the global probe concurrency limit, and returns the result for each
+// address. Addresses that could not be probed before ctx is done report ctx.Err().
+func ProbeMany(ctx context.Context, addrs []string) map[string]LivenessResult {
+	results := make(map[string]LivenessResult, len(addrs))
+	seen := make(map[string]bool, len(addrs))
+	var m sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			live, err := probeWithContext(ctx, []string{addr}, probeDialContext, defaultProbeWidth, defaultProbeTimeout)
+
+			m.Lock()
+			results[addr] = LivenessResult{Live: live, Err: err}
+			m.Unlock()
+		}(addr)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// probeDialTimeout dials a liveness probe connection. Probes are closed as soon as they
+// connect so keepalives are disabled and SO_LINGER is set to 0, resetting the
+// connection on close rather than leaving sockets in TIME_WAIT on the station.
+func probeDialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	return probeDialContext(context.Background(), network, address, timeout)
+}
+
+// probeDialContext is probeDialTimeout that gives up once ctx is done.
+func probeDialContext(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: -1,
+	}
+
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	return conn, nil
+}
+
+// DefaultLivenessProbeInterval is the minimum time between liveness probes sent
+// to any single phantom address unless otherwise configured.
+const DefaultLivenessProbeInterval = 10 * time.Second
+
+// livenessPruneInterval is how often probe records that are no longer fresh are
+// dropped while checking liveness, so stale results do not build up between
+// registration expiry sweeps.
+const livenessPruneInterval = time.Minute
+
+type livenessProbe struct {
+	done    chan struct{}
+	started time.Time
+	live    bool
+	err     error
+
+	// cancelled is set if the probe was cut short by the context of the caller that
+	// sent it, so the result must not be shared.
+	cancelled bool
+}
+
+// phantomProbeLimiter ensures that a phantom address is not probed more often than
+// the configured interval no matter how many registrations reference it. Callers
+// that arrive while a probe for the same address is in flight, or within the
+// interval after it started, share its result instead of sending their own.
+//
+// Completed results may instead be cached for separate live and not live TTLs so
+// that, for example, a responsive phantom is not re-probed for a long time while a
+// quiet one is re-checked quickly. A zero TTL falls back to the interval, so with a
+// zero interval and no TTLs completed results are never reused.
+type phantomProbeLimiter struct {
+	interval  time.Duration
+	liveTTL   time.Duration
+	deadTTL   time.Duration
+	probes    map[string]*livenessProbe
+	lastPrune time.Time
+	m         sync.Mutex
+}
+
+func newPhantomProbeLimiter(interval time.Duration) *phantomProbeLimiter {
+	return &phantomProbeLimiter{
+		interval: interval,
+		probes:   make(map[string]*livenessProbe),
+	}
+}
+
+func (l *phantomProbeLimiter) setInterval(interval time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.interval = interval
+}
+
+func (l *phantomProbeLimiter) setTTLs(live, dead time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.liveTTL = live
+	l.deadTTL = dead
+}
+
+// fresh returns true if p may be shared instead of sending a new probe. Probes in
+// flight are always shared. Must be called with the lock held.
+func (l *phantomProbeLimiter) fresh(p *livenessProbe) bool {
+	ttl := l.interval
+	select {
+	case <-p.done:
+		if p.live && l.liveTTL > 0 {
+			ttl = l.liveTTL
+		} else if !p.live && l.deadTTL > 0 {
+			ttl = l.deadTTL
+		}
+	default:
+		return true
+	}
+	return time.Since(p.started) < ttl
+}
+
+// check runs probe against address unless the phantom IP has a probe in flight or a
+// result that is still fresh, in which case the earlier result is returned.
+func (l *phantomProbeLimiter) check(phantom net.IP, address string, probe func(string) (bool, error)) (bool, error) {
+	return l.checkContext(context.Background(), phantom, address, probe)
+}
+
+// checkContext is check for a probe bounded by ctx. Waiting for a probe sent by
+// another caller also stops when ctx is done. A probe cut short by ctx is not shared,
+// so callers waiting on it send their own.
+func (l *phantomProbeLimiter) checkContext(ctx context.Context, phantom net.IP, address string, probe func(string) (bool, error)) (bool, error) {
+	key := phantom.String()
+
+	for {
+		l.m.Lock()
+		if time.Since(l.lastPrune) > livenessPruneInterval {
+			l.pruneLocked()
+		}
+
+		p, ok := l.probes[key]
+		if ok && l.fresh(p) {
+			l.m.Unlock()
+			select {
+			case <-p.done:
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+			if p.cancelled {
+				continue
+			}
+			return p.live, p.err
+		}
+
+		p = &livenessProbe{
+			done:    make(chan struct{}),
+			started: time.Now(),
+		}
+		l.probes[key] = p
+		l.m.Unlock()
+
+		p.live, p.err = probe(address)
+		if ctx.Err() != nil {
+			p.cancelled = true
+			l.m.Lock()
+			if l.probes[key] == p {
+				delete(l.probes, key)
+			}
+			l.m.Unlock()
+		}
+		close(p.done)
+
+		return p.live, p.err
+	}
+}
+
+// prune drops probe records that can no longer limit a new probe.
+func (l *phantomProbeLimiter) prune() {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.pruneLocked()
+}
+
+// pruneLocked is prune for callers that hold the lock.
+func (l *phantomProbeLimiter) pruneLocked() {
+	l.lastPrune = time.Now()
+	for key, p := range l.probes {
+		if !l.fresh(p) {
+			delete(l.probes, key)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLivenessProbeLimiterCoalesces(t *testing.T) {
+	limiter := newPhantomProbeLimiter(time.Hour)
+
+	var probes int32
+	probe := func(address string) (bool, error) {
+		atomic.AddInt32(&probes, 1)
+		time.Sleep(50 * time.Millisecond)
+		return false, fmt.Errorf("Reached statistical timeout")
+	}
+
+	phantom := net.ParseIP("192.0.2.1")
+
+	// Many registrations on the same phantom, concurrently and in sequence.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			live, _ := limiter.check(phantom, net.JoinHostPort(phantom.String(), fmt.Sprint(port)), probe)
+			assert.False(t, live)
+		}(443 + i)
+	}
+	wg.Wait()
+
+	live, _ := limiter.check(phantom, "192.0.2.1:443", probe)
+	require.False(t, live)
+	require.Equal(t, int32(1), atomic.LoadInt32(&probes))
+
+	// A different phantom is probed independently.
+	_, _ = limiter.check(net.ParseIP("192.0.2.2"), "192.0.2.2:443", probe)
+	require.Equal(t, int32(2), atomic.LoadInt32(&probes))
+}
+
+func TestLivenessProbeLimiterInterval(t *testing.T) {
+	limiter := newPhantomProbeLimiter(100 * time.Millisecond)
+
+	var probes int32
+	probe := func(address string) (bool, error) {
+		atomic.AddInt32(&probes, 1)
+		return true, nil
+	}
+
+	phantom := net.ParseIP("2001:db8::1")
+	_, _ = limiter.check(phantom, "[2001:db8::1]:443", probe)
+	_, _ = limiter.check(phantom, "[2001:db8::1]:443", probe)
+	require.Equal(t, int32(1), atomic.LoadInt32(&probes))
+
+	time.Sleep(150 * time.Millisecond)
+	limiter.prune()
+	require.Equal(t, 0, len(limiter.probes))
+
+	_, _ = limiter.check(phantom, "[2001:db8::1]:443", probe)
+	require.Equal(t, int32(2), atomic.LoadInt32(&probes))
+}
+
+func TestLivenessProbeViaDecoy(t *testing.T) {
+	rm := &RegistrationManager{}
+
+	var m sync.Mutex
+	var decoys, targets []string
+	rm.ProbeViaDecoy = true
+	rm.DecoyProbeDialer = func(decoy net.IP, network, address string, timeout time.Duration) (net.Conn, error) {
+		m.Lock()
+		defer m.Unlock()
+		decoys = append(decoys, decoy.String())
+		targets = append(targets, address)
+		return nil, fmt.Errorf("stub dialer")
+	}
+
+	reg := &DecoyRegistration{
+		DarkDecoy:   net.ParseIP("192.0.2.1"),
+		PhantomPort: 443,
+		DecoyAddr:   net.ParseIP("198.51.100.7"),
+	}
+	_, _ = rm.PhantomIsLive(reg)
+
+	m.Lock()
+	require.NotEmpty(t, decoys)
+	for i := range decoys {
+		require.Equal(t, "198.51.100.7", decoys[i])
+		require.Equal(t, "192.0.2.1:443", targets[i])
+	}
+	m.Unlock()
+
+	// Without the probe mode enabled the decoy path is not used.
+	rm.ProbeViaDecoy = false
+	decoys = nil
+	reg.DarkDecoy = net.ParseIP("127.0.0.1")
+	reg.PhantomPort = 1
+	_, _ = rm.PhantomIsLive(reg)
+	require.Empty(t, decoys)
+}
+
+func TestLivenessProbeDialResets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	readErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			readErr <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	conn, err := probeDialTimeout("tcp", ln.Addr().String(), time.Second)
+	require.Nil(t, err)
+	require.Nil(t, conn.Close())
+
+	// A graceful close would be seen as io.EOF; a linger 0 close resets.
+	select {
+	case err := <-readErr:
+		require.NotNil(t, err)
+		require.True(t, errors.Is(err, syscall.ECONNRESET), "expected reset, got %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for probe connection close")
+	}
+}
+
+func TestLivenessProbeMany(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	live := ln.Addr().String()
+	dead := "192.0.0.2:443"
+
+	results := ProbeMany(context.Background(), []string{live, dead, live})
+	require.Equal(t, 2, len(results))
+	require.True(t, results[live].Live, "%v", results[live].Err)
+	require.False(t, results[dead].Live, "%v", results[dead].Err)
+
+	// Probes that cannot start before the context is done report its error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < maxConcurrentProbes; i++ {
+		probeSlots <- struct{}{}
+	}
+	results = ProbeMany(ctx, []string{live})
+	for i := 0; i < maxConcurrentProbes; i++ {
+		<-probeSlots
+	}
+	require.False(t, results[live].Live)
+	require.Equal(t, context.Canceled, results[live].Err)
+}
+
+func TestLivenessProbeLimiterTTLs(t *testing.T) {
+	limiter := newPhantomProbeLimiter(time.Hour)
+	limiter.setTTLs(300*time.Millisecond, 100*time.Millisecond)
+
+	var probes int32
+	probe := func(live bool) func(string) (bool, error) {
+		return func(address string) (bool, error) {
+			atomic.AddInt32(&probes, 1)
+			return live, nil
+		}
+	}
+
+	livePhantom := net.ParseIP("192.0.2.1")
+	deadPhantom := net.ParseIP("192.0.2.2")
+
+	live, _ := limiter.check(livePhantom, "192.0.2.1:443", probe(true))
+	require.True(t, live)
+	live, _ = limiter.check(deadPhantom, "192.0.2.2:443", probe(false))
+	require.False(t, live)
+	require.Equal(t, int32(2), atomic.LoadInt32(&probes))
+
+	// Within both TTLs both results are reused.
+	_, _ = limiter.check(livePhantom, "192.0.2.1:443", probe(true))
+	_, _ = limiter.check(deadPhantom, "192.0.2.2:443", probe(false))
+	require.Equal(t, int32(2), atomic.LoadInt32(&probes))
+
+	// Past the dead TTL only the dead phantom is probed again.
+	time.Sleep(150 * time.Millisecond)
+	_, _ = limiter.check(livePhantom, "192.0.2.1:443", probe(true))
+	require.Equal(t, int32(2), atomic.LoadInt32(&probes))
+	_, _ = limiter.check(deadPhantom, "192.0.2.2:443", probe(false))
+	require.Equal(t, int32(3), atomic.LoadInt32(&probes))
+
+	// Past the live TTL the live phantom is probed again.
+	time.Sleep(200 * time.Millisecond)
+	_, _ = limiter.check(livePhantom, "192.0.2.1:443", probe(true))
+	require.Equal(t, int32(4), atomic.LoadInt32(&probes))
+
+	// Expired results are pruned independently.
+	time.Sleep(150 * time.Millisecond)
+	limiter.prune()
+	_, liveCached := limiter.probes[livePhantom.String()]
+	_, deadCached := limiter.probes[deadPhantom.String()]
+	require.True(t, liveCached)
+	require.False(t, deadCached)
+}
+
+func TestLivenessProbeLimiterDisabled(t *testing.T) {
+	limiter := newPhantomProbeLimiter(0)
+
+	var probes int32
+	probe := func(address string) (bool, error) {
+		atomic.AddInt32(&probes, 1)
+		return false, nil
+	}
+
+	// With no interval or TTLs every check sends a fresh probe.
+	phantom := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		_, _ = limiter.check(phantom, "192.0.2.1:443", probe)
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&probes))
+}
+
+func TestLivenessProbeLimiterPrunesOnCheck(t *testing.T) {
+	limiter := newPhantomProbeLimiter(50 * time.Millisecond)
+	probe := func(address string) (bool, error) { return false, nil }
+
+	_, _ = limiter.check(net.ParseIP("192.0.2.1"), "192.0.2.1:443", probe)
+	time.Sleep(100 * time.Millisecond)
+
+	// Stale records are dropped by a later check once the prune interval passes,
+	// without waiting for the registration expiry sweep.
+	limiter.lastPrune = time.Now().Add(-2 * livenessPruneInterval)
+	_, _ = limiter.check(net.ParseIP("192.0.2.2"), "192.0.2.2:443", probe)
+	_, stale := limiter.probes["192.0.2.1"]
+	require.False(t, stale)
+	require.Equal(t, 1, len(limiter.probes))
+}
+
+type probeTimeoutError struct{}
+
+func (probeTimeoutError) Error() string   { return "i/o timeout" }
+func (probeTimeoutError) Timeout() bool   { return true }
+func (probeTimeoutError) Temporary() bool { return true }
+
+func TestLivenessCollectsProbeResults(t *testing.T) {
+	// A local listener accepts probes so it is live.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	live, _ := phantomIsLiveDial(ln.Addr().String(), probeDialTimeout)
+	require.True(t, live)
+
+	// A blackholed address never answers so every probe times out.
+	blackhole := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		time.Sleep(timeout)
+		return nil, probeTimeoutError{}
+	}
+	start := time.Now()
+	live, err = phantomIsLiveDial("192.0.2.1:443", blackhole)
+	require.False(t, live)
+	require.NotNil(t, err)
+	require.True(t, time.Since(start) < 2*time.Second)
+
+	// A slow first responder is still seen as live.
+	slow := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		time.Sleep(timeout / 2)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	live, err = phantomIsLiveDial("192.0.2.1:443", slow)
+	require.True(t, live, "%v", err)
+
+	// One failed probe does not outweigh the probes that connected.
+	var dials int32
+	mixed := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil, syscall.ECONNREFUSED
+		}
+		time.Sleep(10 * time.Millisecond)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	live, err = phantomIsLiveDial("192.0.2.1:443", mixed)
+	require.True(t, live)
+	require.Equal(t, "Phantom picked up the connection", err.Error())
+
+	// Probes that all time out early do not wait for the rest of the window.
+	fastTimeout := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, probeTimeoutError{}
+	}
+	start = time.Now()
+	live, _ = phantomIsLiveDial("192.0.2.1:443", fastTimeout)
+	require.False(t, live)
+	require.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestLivenessProbePorts(t *testing.T) {
+	rm := &RegistrationManager{Logger: log.New(ioutil.Discard, "", 0)}
+	require.NotNil(t, rm.SetLivenessProbePorts([]int{443, 0}))
+	require.NotNil(t, rm.SetLivenessProbePorts([]int{65536}))
+
+	// A phantom listening only on a non-443 port is live when that port is probed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NotEqual(t, 443, port)
+
+	require.Nil(t, rm.SetLivenessProbePorts([]int{port}))
+	live, err := rm.PhantomIsLive(&DecoyRegistration{DarkDecoy: net.ParseIP("127.0.0.1")})
+	require.True(t, live, "%v", err)
+
+	// Probes are spread over every configured port with the address formatted for
+	// each, and any port answering makes the phantom live.
+	var m sync.Mutex
+	dialed := map[string]int{}
+	answering := ""
+	rm.ProbeViaDecoy = true
+	rm.DecoyProbeDialer = func(decoy net.IP, network, address string, timeout time.Duration) (net.Conn, error) {
+		m.Lock()
+		dialed[address]++
+		m.Unlock()
+		if address == answering {
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+		return nil, probeTimeoutError{}
+	}
+	require.Nil(t, rm.SetLivenessProbePorts([]int{80, 443, 8443}))
+
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("2001:db8::1"), DecoyAddr: net.ParseIP("198.51.100.1")}
+	live, _ = rm.PhantomIsLive(reg)
+	require.False(t, live)
+	m.Lock()
+	require.Equal(t, 3, len(dialed))
+	for _, address := range []string{"[2001:db8::1]:80", "[2001:db8::1]:443", "[2001:db8::1]:8443"} {
+		require.True(t, dialed[address] > 0, "%s not probed", address)
+	}
+	m.Unlock()
+
+	answering = "[2001:db8::1]:8443"
+	live, _ = rm.PhantomIsLive(reg)
+	require.True(t, live)
+
+	// Without configured ports the registration phantom port is probed.
+	require.Nil(t, rm.SetLivenessProbePorts(nil))
+	require.Equal(t, []string{"192.0.2.1:443"}, rm.probeAddresses(&DecoyRegistration{}, net.ParseIP("192.0.2.1")))
+	require.Equal(t, []string{"192.0.2.1:8080"}, rm.probeAddresses(&DecoyRegistration{PhantomPort: 8080}, net.ParseIP("192.0.2.1")))
+}
+
+func TestLivenessProbeContext(t *testing.T) {
+	// A blackholed phantom that only gives up when the probe is cancelled.
+	var started, finished int32
+	blackhole := func(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+		atomic.AddInt32(&started, 1)
+		defer atomic.AddInt32(&finished, 1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	// Cancelling the caller's context aborts the outstanding dials promptly.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	live, err := phantomIsLiveDialContext(ctx, []string{"192.0.2.1:443"}, blackhole, 8, time.Minute)
+	require.False(t, live)
+	require.True(t, errors.Is(err, context.Canceled), "%v", err)
+	require.True(t, time.Since(start) < time.Second)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&finished) < 8 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.Equal(t, int32(8), atomic.LoadInt32(&started))
+	require.Equal(t, int32(8), atomic.LoadInt32(&finished))
+
+	// The context deadline bounds the probe like cancellation.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = phantomIsLiveDialContext(ctx, []string{"192.0.2.1:443"}, blackhole, 4, time.Minute)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	// The probe timeout ends the probe as not live, without a context error.
+	start = time.Now()
+	live, err = phantomIsLiveDialContext(context.Background(), []string{"192.0.2.1:443"}, blackhole, 4, 20*time.Millisecond)
+	require.False(t, live)
+	require.NotNil(t, err)
+	require.False(t, errors.Is(err, context.DeadlineExceeded))
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestLivenessProbeOptions(t *testing.T) {
+	var m sync.Mutex
+	dialed := map[string]int{}
+	var timeouts []time.Duration
+	rm := &RegistrationManager{
+		Logger:        log.New(ioutil.Discard, "", 0),
+		ProbeViaDecoy: true,
+		DecoyProbeDialer: func(decoy net.IP, network, address string, timeout time.Duration) (net.Conn, error) {
+			m.Lock()
+			dialed[address]++
+			timeouts = append(timeouts, timeout)
+			m.Unlock()
+			return nil, probeTimeoutError{}
+		},
+	}
+	reg := &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1"), DecoyAddr: net.ParseIP("198.51.100.1")}
+
+	// Defaults to 4 probes.
+	live, _ := rm.PhantomIsLive(reg)
+	require.False(t, live)
+	require.Equal(t, 4, dialed["192.0.2.1:443"])
+	require.Equal(t, defaultProbeTimeout, timeouts[0])
+
+	rm.SetLivenessProbeOptions(8, 50*time.Millisecond)
+	dialed, timeouts = map[string]int{}, nil
+	live, _ = rm.PhantomIsLive(reg)
+	require.False(t, live)
+	require.Equal(t, 8, dialed["192.0.2.1:443"])
+	require.Equal(t, 50*time.Millisecond, timeouts[0])
+
+	// Every port is probed even if there are more ports than probes.
+	require.Nil(t, rm.SetLivenessProbePorts([]int{80, 443, 8443}))
+	rm.SetLivenessProbeOptions(2, 0)
+	dialed, timeouts = map[string]int{}, nil
+	_, _ = rm.PhantomIsLive(reg)
+	require.Equal(t, 3, len(dialed))
+	require.Equal(t, defaultProbeTimeout, timeouts[0])
+}
+
+func TestLivenessProbeLimiterContext(t *testing.T) {
+	limiter := newPhantomProbeLimiter(time.Hour)
+	phantom := net.ParseIP("192.0.2.1")
+
+	release := make(chan struct{})
+	var probes int32
+	probe := func(address string) (bool, error) {
+		atomic.AddInt32(&probes, 1)
+		<-release
+		return false, fmt.Errorf("Reached statistical timeout")
+	}
+
+	// A caller waiting on another caller's probe stops waiting when its context is
+	// done.
+	go limiter.check(phantom, "192.0.2.1:443", probe)
+	for atomic.LoadInt32(&probes) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := limiter.checkContext(ctx, phantom, "192.0.2.1:443", probe)
+	require.Equal(t, context.DeadlineExceeded, err)
+	close(release)
+
+	// A probe cut short by its caller's context is not reused.
+	other := net.ParseIP("192.0.2.2")
+	ctx, cancel = context.WithCancel(context.Background())
+	cancelled := func(address string) (bool, error) {
+		cancel()
+		return false, ctx.Err()
+	}
+	_, err = limiter.checkContext(ctx, other, "192.0.2.2:443", cancelled)
+	require.Equal(t, context.Canceled, err)
+
+	live, err := limiter.check(other, "192.0.2.2:443", func(string) (bool, error) {
+		return true, fmt.Errorf("Phantom picked up the connection")
+	})
+	require.True(t, live, "%v", err)
+}
+
+func TestNewRegistrationContext(t *testing.T) {
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_API
+
+	// Without ProbeOnRegistration the phantom is not probed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reg, err := rm.NewRegistrationContext(ctx, &c2s, &keys, false, &regSource, nil)
+	require.Nil(t, err)
+	require.NotNil(t, reg)
+
+	// Once the context is done the registration is rejected with the context error.
+	rm.ProbeOnRegistration = true
+	reg, err = rm.NewRegistrationContext(ctx, &c2s, &keys, false, &regSource, nil)
+	require.Nil(t, reg)
+	require.True(t, errors.Is(err, context.Canceled), "%v", err)
+}
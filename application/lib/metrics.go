@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registrationMetrics holds the Prometheus collectors for a RegistrationManager. A nil
+// *registrationMetrics records nothing so the metrics stay optional.
+type registrationMetrics struct {
+	added        prometheus.Counter
+	expired      prometheus.Counter
+	deduplicated prometheus.Counter
+
+	tickEvictions prometheus.Histogram
+	tickDuration  prometheus.Histogram
+
+	livenessResults *prometheus.CounterVec
+	livenessLatency prometheus.Histogram
+}
+
+// RegisterMetrics registers Prometheus collectors for the registrations tracked by the
+// manager and for phantom liveness probes with registerer. Nothing is recorded unless
+// this is called, so stations that do not export metrics need no registry.
+func (regManager *RegistrationManager) RegisterMetrics(registerer prometheus.Registerer) error {
+	m := &registrationMetrics{
+		added: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "conjure",
+			Subsystem: "registrations",
+			Name:      "added_total",
+			Help:      "Registrations added to the registration table.",
+		}),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "conjure",
+			Subsystem: "registrations",
+			Name:      "expired_total",
+			Help:      "Registrations removed from the registration table after timing out.",
+		}),
+		deduplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "conjure",
+			Subsystem: "registrations",
+			Name:      "deduplicated_total",
+			Help:      "Registrations received again while already tracked.",
+		}),
+		tickEvictions: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "conjure",
+			Subsystem: "registrations",
+			Name:      "evictions_per_tick",
+			Help:      "Registrations evicted by each run of the expiry loop.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+		}),
+		tickDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "conjure",
+			Subsystem: "registrations",
+			Name:      "eviction_duration_seconds",
+			Help:      "Time taken by each run of the expiry loop.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		livenessResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "conjure",
+			Subsystem: "liveness",
+			Name:      "probes_total",
+			Help:      "Phantom liveness probes by result (live or dead).",
+		}, []string{"result"}),
+		livenessLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "conjure",
+			Subsystem: "liveness",
+			Name:      "probe_duration_seconds",
+			Help:      "Time taken to decide whether a phantom is live.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+		}),
+	}
+
+	active := activeBySubnetCollector{
+		desc: prometheus.NewDesc("conjure_registrations_active",
+			"Active registrations by the phantom subnet their phantom was selected from.",
+			[]string{"subnet"}, nil),
+	}
+
+	s := Stat()
+	dropped := statCounterCollector{
+		statCounter("vetoed_total", "Registrations dropped by a registration veto.", &s.vetoedRegistrations),
+		statCounter("backpressure_total", "Registrations dropped because the station was backlogged.", &s.backpressureRegistrations),
+		statCounter("rate_limited_total", "Registrations dropped by the per-client rate limit.", &s.rateLimitedRegistrations),
+		statCounter("dropped_callbacks_total", "Observer notifications dropped because the callback queue was full.", &s.droppedCallbacks),
+		statCounter("id_collisions_total", "Registrations whose id prefix collided with another active registration.", &s.idCollisions),
+	}
+
+	collectors := []prometheus.Collector{active, dropped, m.added, m.expired, m.deduplicated, m.tickEvictions, m.tickDuration, m.livenessResults, m.livenessLatency}
+	for _, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
+	}
+
+	regManager.registeredDecoys.m.Lock()
+	regManager.registeredDecoys.metrics = m
+	regManager.registeredDecoys.m.Unlock()
+	return nil
+}
+
+// activeBySubnetCollector exports the active registration counts per phantom subnet
+// kept by Stat() as one gauge series per subnet.
+type activeBySubnetCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c activeBySubnetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c activeBySubnetCollector) Collect(ch chan<- prometheus.Metric) {
+	for subnet, n := range Stat().ActiveRegistrationsBySubnet() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), subnet)
+	}
+}
+
+// statCounterCollector exports counters kept by Stat() that are never reset.
+type statCounterCollector []statCounterValue
+
+type statCounterValue struct {
+	desc  *prometheus.Desc
+	value *int64
+}
+
+func statCounter(name, help string, value *int64) statCounterValue {
+	return statCounterValue{
+		desc:  prometheus.NewDesc(prometheus.BuildFQName("conjure", "registrations", name), help, nil, nil),
+		value: value,
+	}
+}
+
+func (c statCounterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, counter := range c {
+		ch <- counter.desc
+	}
+}
+
+func (c statCounterCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, counter := range c {
+		ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(atomic.LoadInt64(counter.value)))
+	}
+}
+
+func (m *registrationMetrics) addRegistration() {
+	if m == nil {
+		return
+	}
+	m.added.Inc()
+}
+
+func (m *registrationMetrics) expiryTick(evicted int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.expired.Add(float64(evicted))
+	m.tickEvictions.Observe(float64(evicted))
+	m.tickDuration.Observe(duration.Seconds())
+}
+
+func (m *registrationMetrics) deduplicateRegistration() {
+	if m == nil {
+		return
+	}
+	m.deduplicated.Inc()
+}
+
+func (m *registrationMetrics) livenessProbe(live bool, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	result := "dead"
+	if live {
+		result = "live"
+	}
+	m.livenessResults.WithLabelValues(result).Inc()
+	m.livenessLatency.Observe(duration.Seconds())
+}
@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+// gathered returns the value of the named counter or gauge (summed over labels
+// matching result if given) or the sample count of the named histogram.
+func gathered(t *testing.T, registry *prometheus.Registry, name string, result string) float64 {
+	return gatheredLabel(t, registry, name, "result", result)
+}
+
+// gatheredLabel is gathered for the series with label set to value, or all series if
+// value is empty.
+func gatheredLabel(t *testing.T, registry *prometheus.Registry, name string, label, value string) float64 {
+	families, err := registry.Gather()
+	require.Nil(t, err)
+
+	var total float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if value != "" {
+				matched := false
+				for _, l := range metric.GetLabel() {
+					if l.GetName() == label && l.GetValue() == value {
+						matched = true
+					}
+				}
+				if !matched {
+					continue
+				}
+			}
+
+			switch {
+			case metric.Counter != nil:
+				total += metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				total += metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				total += float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return total
+}
+
+func TestRegistrationMetrics(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	// Nothing is recorded before the metrics are registered.
+	require.Nil(t, rm.AddRegistration(&DecoyRegistration{
+		DarkDecoy: net.ParseIP("192.0.2.100"),
+		Keys:      &ConjureSharedKeys{SharedSecret: []byte("before metrics")},
+	}))
+
+	registry := prometheus.NewRegistry()
+	require.Nil(t, rm.RegisterMetrics(registry))
+	require.NotNil(t, rm.RegisterMetrics(registry), "collectors registered twice")
+
+	var regs []*DecoyRegistration
+	for i := 0; i < 2; i++ {
+		reg := &DecoyRegistration{
+			DarkDecoy: net.ParseIP(fmt.Sprintf("192.0.2.%d", i+1)),
+			Keys:      &ConjureSharedKeys{SharedSecret: []byte(fmt.Sprintf("%d metrics", i))},
+		}
+		require.Nil(t, rm.AddRegistration(reg))
+		regs = append(regs, reg)
+	}
+	require.Nil(t, rm.TrackRegistration(regs[0]))
+
+	require.Equal(t, float64(2), gathered(t, registry, "conjure_registrations_added_total", ""))
+	require.Equal(t, float64(1), gathered(t, registry, "conjure_registrations_deduplicated_total", ""))
+
+	// Replaying a valid registration is counted once, like tracking it again.
+	require.Nil(t, rm.AddRegistration(regs[1]))
+	require.Equal(t, float64(2), gathered(t, registry, "conjure_registrations_deduplicated_total", ""))
+	require.Equal(t, int32(2), regs[1].regCount)
+
+	for _, timeout := range rm.registeredDecoys.decoysTimeouts {
+		timeout.registrationTime = time.Now().Add(-7 * time.Hour)
+	}
+	rm.RemoveOldRegistrations()
+	require.Equal(t, float64(3), gathered(t, registry, "conjure_registrations_expired_total", ""))
+	require.Equal(t, float64(1), gathered(t, registry, "conjure_registrations_evictions_per_tick", ""))
+	require.Equal(t, float64(1), gathered(t, registry, "conjure_registrations_eviction_duration_seconds", ""))
+
+	// A phantom that accepts the connection is live.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	reg := &DecoyRegistration{
+		DarkDecoy:   net.ParseIP("127.0.0.1"),
+		PhantomPort: uint32(ln.Addr().(*net.TCPAddr).Port),
+	}
+	live, _ := rm.PhantomIsLive(reg)
+	require.True(t, live)
+	require.Equal(t, float64(1), gathered(t, registry, "conjure_liveness_probes_total", "live"))
+	require.Equal(t, float64(0), gathered(t, registry, "conjure_liveness_probes_total", "dead"))
+	require.Equal(t, float64(1), gathered(t, registry, "conjure_liveness_probe_duration_seconds", ""))
+}
+
+func TestRegistrationMetricsActiveBySubnet(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	registry := prometheus.NewRegistry()
+	require.Nil(t, rm.RegisterMetrics(registry))
+
+	source := pb.RegistrationSource_Detector
+	subnets := []string{"203.0.113.0/25", "203.0.113.128/25"}
+	for i, subnet := range subnets {
+		for j := 0; j <= i; j++ {
+			Stat().AddReg(1, &source, subnet)
+		}
+	}
+
+	// One series per subnet.
+	require.Equal(t, float64(1), gatheredLabel(t, registry, "conjure_registrations_active", "subnet", subnets[0]))
+	require.Equal(t, float64(2), gatheredLabel(t, registry, "conjure_registrations_active", "subnet", subnets[1]))
+
+	Stat().ExpireReg(1, &source, subnets[1])
+	require.Equal(t, float64(1), gatheredLabel(t, registry, "conjure_registrations_active", "subnet", subnets[1]))
+
+	Stat().ExpireReg(1, &source, subnets[0])
+	Stat().ExpireReg(1, &source, subnets[1])
+	require.Equal(t, float64(0), gatheredLabel(t, registry, "conjure_registrations_active", "subnet", subnets[0]))
+}
+
+func TestRegistrationMetricsDropped(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	registry := prometheus.NewRegistry()
+	require.Nil(t, rm.RegisterMetrics(registry))
+
+	counters := map[string]func(){
+		"conjure_registrations_vetoed_total":            Stat().AddVetoedReg,
+		"conjure_registrations_backpressure_total":      Stat().AddBackpressureReg,
+		"conjure_registrations_rate_limited_total":      Stat().AddRateLimitedReg,
+		"conjure_registrations_dropped_callbacks_total": Stat().AddDroppedCallback,
+	}
+	for name, add := range counters {
+		before := gathered(t, registry, name, "")
+		add()
+		require.Equal(t, before+1, gathered(t, registry, name, ""), name)
+	}
+
+	before := gathered(t, registry, "conjure_registrations_id_collisions_total", "")
+	Stat().AddIDCollision("00000000", 2)
+	require.Equal(t, before+1, gathered(t, registry, "conjure_registrations_id_collisions_total", ""))
+}
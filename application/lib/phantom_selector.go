@@ -12,20 +12,31 @@ import (
 	wr "github.com/mroth/weightedrand"
 )
 
+// ErrEmptyPool is returned by phantom selection when the subnets configured for a
+// generation leave no addresses to select from.
+var ErrEmptyPool = errors.New("no phantom addresses available to select from")
+
+// ErrUnknownGeneration is returned by phantom selection when no subnets are configured
+// for the requested generation. There is no default set of subnets since a client
+// using a generation the station does not know would not select the same phantom.
+var ErrUnknownGeneration = errors.New("generation number not recognized")
+
 // getSubnets - return EITHER all subnet strings as one composite array if we are
 //		selecting unweighted, or return the array associated with the (seed) selected
-//		array of subnet strings based on the associated weights
-func (sc *SubnetConfig) getSubnets(seed []byte, weighted bool) []string {
+//		array of subnet strings based on the associated weights. An error is returned
+//		if the seed cannot be decoded or no entry can be chosen.
+func (sc *SubnetConfig) getSubnets(seed []byte, weighted bool) ([]string, error) {
 
 	var out []string = []string{}
 
 	if weighted {
-		// seed random with hkdf derived seed provided by client
+		// seed random with hkdf derived seed provided by client. A local source is
+		// used so that selection does not depend on (or race with) the global one.
 		seedInt, err := binary.ReadVarint(bytes.NewBuffer(seed))
 		if err != nil {
-			return nil
+			return nil, fmt.Errorf("failed to decode seed: %v", err)
 		}
-		rand.Seed(seedInt)
+		rng := rand.New(rand.NewSource(seedInt))
 
 		choices := make([]wr.Choice, 0, len(sc.WeightedSubnets))
 		for _, cjSubnet := range sc.WeightedSubnets {
@@ -33,10 +44,10 @@ func (sc *SubnetConfig) getSubnets(seed []byte, weighted bool) []string {
 		}
 		c, err := wr.NewChooser(choices...)
 		if err != nil {
-			return out
+			return nil, err
 		}
 
-		out = c.Pick().([]string)
+		out = c.PickSource(rng).([]string)
 	} else {
 
 		// Use unweighted config for subnets, concat all into one array and return.
@@ -47,7 +58,21 @@ func (sc *SubnetConfig) getSubnets(seed []byte, weighted bool) []string {
 		}
 	}
 
-	return out
+	return out, nil
+}
+
+// hasSubnets returns true if any entry that can be chosen (has a non-zero weight)
+// lists a subnet. Otherwise every selection from the config fails.
+func (sc *SubnetConfig) hasSubnets() bool {
+	if sc == nil {
+		return false
+	}
+	for _, cjSubnet := range sc.WeightedSubnets {
+		if cjSubnet.Weight > 0 && len(cjSubnet.Subnets) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // SubnetFilter - Filter IP subnets based on whatever to prevent specific subnets from
@@ -111,8 +136,22 @@ func NewPhantomIPSelector() (*PhantomIPSelector, error) {
 	return GetPhantomSubnetSelector()
 }
 
-// Select - select an ip address from the list of subnets associated with the specified generation
+// Select - select an ip address from the list of subnets associated with the specified generation.
+//		The result depends only on the client seed, the generation and the subnets configured
+//		for that generation, so any station (or the same station after a restart) loading the
+//		same configuration selects the same phantom for a given client.
 func (p *PhantomIPSelector) Select(seed []byte, generation uint, v6Support bool) (net.IP, error) {
+	addr, _, err := p.SelectWithSubnet(seed, generation, v6Support)
+	return addr, err
+}
+
+// SelectWithSubnet - select an ip address from the list of subnets associated with the
+//		specified generation, also returning the configured subnet it was chosen from.
+//		Selection is a single draw determined by the seed: the client derives its phantom
+//		the same way, so the station must never re-draw (e.g. to skip an address) or the
+//		two would disagree. Addresses that cannot be used are dropped after selection
+//		instead (see IsBlocklistedPhantom).
+func (p *PhantomIPSelector) SelectWithSubnet(seed []byte, generation uint, v6Support bool) (net.IP, *net.IPNet, error) {
 
 	type idNet struct {
 		min, max big.Int
@@ -122,23 +161,35 @@ func (p *PhantomIPSelector) Select(seed []byte, generation uint, v6Support bool)
 
 	genConfig := p.GetSubnetsByGeneration(generation)
 	if genConfig == nil {
-		return nil, fmt.Errorf("generation number not recognized")
+		return nil, nil, ErrUnknownGeneration
+	}
+	if p.emptyGenerations[generation] {
+		return nil, nil, emptyPool(generation)
 	}
 
-	genSubnetStrings := genConfig.getSubnets(seed, true)
+	genSubnetStrings, err := genConfig.getSubnets(seed, true)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	genSubnets, err := parseSubnets(genSubnetStrings)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if v6Support == false {
 		genSubnets, err = V4Only(genSubnets)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
+	if len(genSubnets) == 0 {
+		// Clients with v6 support can still select from the generation, so this is
+		// not counted as an empty pool.
+		return nil, nil, fmt.Errorf("%w: no IPv4 subnets for generation %d", ErrEmptyPool, generation)
+	}
+
 	addressTotal := big.NewInt(0)
 	for _, _net := range genSubnets {
 		netMaskOnes, _ := _net.Mask.Size()
@@ -161,34 +212,68 @@ func (p *PhantomIPSelector) Select(seed []byte, generation uint, v6Support bool)
 				idNets = append(idNets, _idNet)
 			}
 		} else {
-			return nil, fmt.Errorf("failed to parse %v", _net)
+			return nil, nil, fmt.Errorf("failed to parse %v", _net)
 		}
 	}
+	if addressTotal.Cmp(big.NewInt(0)) <= 0 {
+		return nil, nil, fmt.Errorf("%w: generation %d", ErrEmptyPool, generation)
+	}
+
 	id := &big.Int{}
 	id.SetBytes(seed)
 	if id.Cmp(addressTotal) > 0 {
 		id.Mod(id, addressTotal)
 	}
 	if id.Cmp(addressTotal) == 0 {
-		return nil, fmt.Errorf("No valid addresses to select from")
+		return nil, nil, fmt.Errorf("No valid addresses to select from")
 	}
 	if addressTotal.Cmp(big.NewInt(0)) <= 0 {
-		return nil, fmt.Errorf("No valid addresses specified")
+		return nil, nil, fmt.Errorf("No valid addresses specified")
 	}
 
 	var result net.IP
+	var resultNet *net.IPNet
 	for _, _idNet := range idNets {
 		if _idNet.max.Cmp(id) >= 0 && _idNet.min.Cmp(id) == -1 {
 			result, err = SelectAddrFromSubnet(seed, &_idNet.net)
 			if err != nil {
-				return nil, fmt.Errorf("Failed to chose IP address: %v", err)
+				return nil, nil, fmt.Errorf("Failed to chose IP address: %v", err)
 			}
+			subnet := _idNet.net
+			resultNet = &subnet
 		}
 	}
 	if result == nil {
-		return nil, errors.New("let's rewrite the phantom address selector")
+		return nil, nil, errors.New("let's rewrite the phantom address selector")
+	}
+	return result, resultNet, nil
+}
+
+// hasV4Subnets returns true if the subnets the seed selects from in the generation
+// include an IPv4 subnet, so that a v4 phantom can be selected.
+func (p *PhantomIPSelector) hasV4Subnets(seed []byte, generation uint) bool {
+	genConfig := p.GetSubnetsByGeneration(generation)
+	if genConfig == nil {
+		return false
+	}
+
+	subnetStrings, err := genConfig.getSubnets(seed, true)
+	if err != nil {
+		return false
+	}
+	subnets, err := parseSubnets(subnetStrings)
+	if err != nil {
+		return false
 	}
-	return result, nil
+	v4Subnets, _ := V4Only(subnets)
+	return len(v4Subnets) > 0
+}
+
+// emptyPool records that selection for a generation configured without any subnets
+// had no addresses to choose from.
+func emptyPool(generation uint) error {
+	Stat().AddEmptyPool(generation)
+	return fmt.Errorf("%w: generation %d", ErrEmptyPool, generation)
 }
 
 // SelectAddrFromSubnet - given a seed and a CIDR block choose an address.
@@ -211,9 +296,9 @@ func SelectAddrFromSubnet(seed []byte, net1 *net.IPNet) (net.IP, error) {
 		return nil, err
 	}
 
-	rand.Seed(seedInt)
+	rng := rand.New(rand.NewSource(seedInt))
 	randBytes := make([]byte, addrLen/8)
-	_, err = rand.Read(randBytes)
+	_, err = rng.Read(randBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -255,10 +340,25 @@ func (p *PhantomIPSelector) AddGeneration(gen int, subnets *SubnetConfig) uint {
 		ugen = p.newGenerationIndex()
 	}
 
-	p.Networks[ugen] = subnets
+	p.setGeneration(ugen, subnets)
 	return ugen
 }
 
+// setGeneration stores the subnets for a generation, noting once whether they leave
+// nothing to select from so that selection need not check every time.
+func (p *PhantomIPSelector) setGeneration(generation uint, subnets *SubnetConfig) {
+	p.Networks[generation] = subnets
+
+	if subnets.hasSubnets() {
+		delete(p.emptyGenerations, generation)
+		return
+	}
+	if p.emptyGenerations == nil {
+		p.emptyGenerations = make(map[uint]bool)
+	}
+	p.emptyGenerations[generation] = true
+}
+
 func (p *PhantomIPSelector) newGenerationIndex() uint {
 	maxGen := uint(0)
 	for k := range p.Networks {
@@ -280,12 +380,13 @@ func (p *PhantomIPSelector) IsTakenGeneration(gen uint) bool {
 // RemoveGeneration - remove a generation from the mapping
 func (p *PhantomIPSelector) RemoveGeneration(generation uint) bool {
 	p.Networks[generation] = nil
+	delete(p.emptyGenerations, generation)
 	return true
 }
 
 //UpdateGeneration - Update the subnet list associated with a specific generation
 func (p *PhantomIPSelector) UpdateGeneration(generation uint, subnets *SubnetConfig) bool {
-	p.Networks[generation] = subnets
+	p.setGeneration(generation, subnets)
 	return true
 }
 
@@ -2,9 +2,12 @@ package lib
 
 import (
 	"encoding/hex"
+	"errors"
+	"math/rand"
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -57,6 +60,7 @@ func TestPhantomsSelectFromUnknownGen(t *testing.T) {
 
 	phantomAddr, err := phantomSelector.Select(seed, 0, false)
 	require.Equal(t, err.Error(), "generation number not recognized")
+	require.True(t, errors.Is(err, ErrUnknownGeneration))
 	assert.Nil(t, phantomAddr)
 }
 
@@ -114,3 +118,164 @@ func TestPhantomsV6OnlyFilter(t *testing.T) {
 	require.Equal(t, 2, len(testNetsParsed))
 
 }
+
+// Selection must depend only on (seed, generation, subnets) so that a station
+// restart does not remap clients to different phantoms.
+func TestPhantomsSelectionStableAcrossInstances(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+
+	seeds := []string{
+		"5a87133b68ea3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f",
+		"793a691831702c7a68aff8bc5a3ee28a",
+		"1f2e3d4c5b6a79889706a5b4c3d2e1f7",
+	}
+
+	selectAll := func() []string {
+		phantomSelector, err := NewPhantomIPSelector()
+		require.Nil(t, err, "Failed to create the PhantomIPSelector Object")
+
+		var out []string
+		for _, seedStr := range seeds {
+			seed, err := hex.DecodeString(seedStr)
+			require.Nil(t, err)
+			for _, gen := range []uint{1, 2, 957} {
+				for _, v6 := range []bool{false, true} {
+					addr, err := phantomSelector.Select(seed, gen, v6)
+					require.Nil(t, err)
+					out = append(out, addr.String())
+				}
+			}
+		}
+		return out
+	}
+
+	first := selectAll()
+
+	// Disturb the global random source between instances; selection must not
+	// depend on it.
+	rand.Seed(time.Now().UnixNano())
+	_ = rand.Int63()
+
+	second := selectAll()
+	require.Equal(t, first, second)
+}
+
+// The client derives its phantom with a single seeded draw, so the station must make
+// the same draw and never retry with a different one.
+func TestPhantomsSelectWithSubnetSingleDraw(t *testing.T) {
+	phantomSelector := &PhantomIPSelector{Networks: make(map[uint]*SubnetConfig)}
+	gen := phantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.0.2.0/24", "2001:db8::/32"}}},
+	})
+
+	for i := 0; i < 50; i++ {
+		seed := make([]byte, 32)
+		rand.New(rand.NewSource(int64(i))).Read(seed)
+		// keep the varint the draw is seeded with short enough to decode
+		seed[2] &= 0x7f
+
+		for _, v6 := range []bool{false, true} {
+			addr, subnet, err := phantomSelector.SelectWithSubnet(seed, gen, v6)
+			require.Nil(t, err)
+			require.True(t, subnet.Contains(addr))
+
+			// The address is exactly the seeded draw from the selected subnet.
+			draw, err := SelectAddrFromSubnet(seed, subnet)
+			require.Nil(t, err)
+			require.True(t, draw.Equal(addr), "%v re-drawn as %v", draw, addr)
+
+			// Selecting again gives the same result.
+			again, againSubnet, err := phantomSelector.SelectWithSubnet(seed, gen, v6)
+			require.Nil(t, err)
+			require.True(t, addr.Equal(again))
+			require.Equal(t, subnet.String(), againSubnet.String())
+		}
+	}
+}
+
+func TestPhantomsSelectEmptyPool(t *testing.T) {
+	phantomSelector := &PhantomIPSelector{Networks: make(map[uint]*SubnetConfig)}
+
+	seed, _ := hex.DecodeString("5a87133b68ea3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f")
+
+	emptyGen := phantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{}}},
+	})
+	phantomAddr, err := phantomSelector.Select(seed, emptyGen, false)
+	require.True(t, errors.Is(err, ErrEmptyPool))
+	assert.Nil(t, phantomAddr)
+	require.Equal(t, int64(1), Stat().EmptyPoolSelections(emptyGen))
+
+	// A v6 only generation has nothing to offer clients without v6 support, but v6
+	// clients can still select from it so it is not counted as empty.
+	v6Gen := phantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"2001:48a8:687f:1::/64"}}},
+	})
+	_, err = phantomSelector.Select(seed, v6Gen, false)
+	require.True(t, errors.Is(err, ErrEmptyPool))
+	require.Equal(t, int64(0), Stat().EmptyPoolSelections(v6Gen))
+
+	_, err = phantomSelector.Select(seed, v6Gen, true)
+	require.Nil(t, err)
+
+	// A seed that cannot be decoded is an error for that client only.
+	_, err = phantomSelector.Select([]byte{}, v6Gen, true)
+	require.NotNil(t, err)
+	require.False(t, errors.Is(err, ErrEmptyPool))
+	require.Equal(t, int64(0), Stat().EmptyPoolSelections(v6Gen))
+
+	// Replacing the subnets of a generation updates whether it is empty.
+	phantomSelector.UpdateGeneration(emptyGen, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.0.2.0/24"}}},
+	})
+	_, err = phantomSelector.Select(seed, emptyGen, false)
+	require.Nil(t, err)
+}
+
+func TestPhantomsWeightedSelection(t *testing.T) {
+	phantomSelector := &PhantomIPSelector{Networks: make(map[uint]*SubnetConfig)}
+
+	_, favored, _ := net.ParseCIDR("192.0.2.0/24")
+	mostlyFavored := phantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 9, Subnets: []string{"192.0.2.0/24"}},
+			{Weight: 1, Subnets: []string{"198.51.100.0/24"}},
+		},
+	})
+	rarelyFavored := phantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"192.0.2.0/24"}},
+			{Weight: 9, Subnets: []string{"198.51.100.0/24"}},
+		},
+	})
+
+	rng := rand.New(rand.NewSource(1))
+	share := func(generation uint) float64 {
+		selected, inFavored := 0, 0
+		for i := 0; i < 2000; i++ {
+			seed := make([]byte, 32)
+			rng.Read(seed)
+
+			addr, err := phantomSelector.Select(seed, generation, false)
+			if err != nil {
+				continue
+			}
+			selected++
+			if favored.Contains(addr) {
+				inFavored++
+			}
+
+			// The same seed and generation always select the same address.
+			again, err := phantomSelector.Select(seed, generation, false)
+			require.Nil(t, err)
+			require.True(t, addr.Equal(again))
+		}
+		require.True(t, selected > 1900)
+		return float64(inFavored) / float64(selected)
+	}
+
+	mostly := share(mostlyFavored)
+	require.True(t, mostly > 0.85 && mostly < 0.95, "share of favored subnet %f", mostly)
+	rarely := share(rarelyFavored)
+	require.True(t, rarely > 0.05 && rarely < 0.15, "share of favored subnet %f", rarely)
+}
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 
@@ -15,13 +16,41 @@ type ConjurePhantomSubnet struct {
 }
 
 // SubnetConfig - Configuration of subnets for Conjure to choose a Phantom out of.
+// Selection first picks one of the WeightedSubnets with probability proportional to
+// its weight, using the client seed, then an address from that entry's subnets.
 type SubnetConfig struct {
 	WeightedSubnets []ConjurePhantomSubnet
 }
 
+// validate checks that every subnet parses and that at least one entry has a
+// non-zero weight, so that a bad config is rejected when it is loaded rather than
+// failing every selection for the generation.
+func (sc *SubnetConfig) validate() error {
+	if sc == nil || len(sc.WeightedSubnets) == 0 {
+		return fmt.Errorf("no weighted subnets")
+	}
+
+	var totalWeight uint64
+	for _, entry := range sc.WeightedSubnets {
+		totalWeight += uint64(entry.Weight)
+		for _, subnet := range entry.Subnets {
+			if _, _, err := net.ParseCIDR(subnet); err != nil {
+				return err
+			}
+		}
+	}
+	if totalWeight == 0 {
+		return fmt.Errorf("all subnet weights are zero")
+	}
+	return nil
+}
+
 // PhantomIPSelector - Object for tracking current generation to SubnetConfig Mapping.
 type PhantomIPSelector struct {
 	Networks map[uint]*SubnetConfig
+
+	// generations added without any subnets to select from
+	emptyGenerations map[uint]bool
 }
 
 // type shim because github.com/pelletier/go-toml doesn't allow for integer value keys to maps so
@@ -60,6 +89,9 @@ func SubnetsFromTomlFile(path string) (*PhantomIPSelector, error) {
 		if err != nil {
 			return nil, err
 		}
+		if err := set.validate(); err != nil {
+			return nil, fmt.Errorf("invalid subnets for generation %d: %v", g, err)
+		}
 		// fmt.Printf("[GetPhantomSubnetSelector] adding %d, %+v\n", g, set)
 		pss.AddGeneration(g, set)
 	}
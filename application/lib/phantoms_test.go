@@ -1,7 +1,9 @@
 package lib
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -21,3 +23,30 @@ func TestPhantomsParse(t *testing.T) {
 	require.Equal(t, len(sc.WeightedSubnets[0].Subnets), 2)
 	require.Contains(t, sc.WeightedSubnets[0].Subnets, "192.122.190.0/24")
 }
+
+func TestPhantomsParseInvalid(t *testing.T) {
+	configs := map[string]string{
+		"zero weights": `
+[Networks]
+    [Networks.1]
+        [[Networks.1.WeightedSubnets]]
+            Weight = 0
+            Subnets = ["192.0.2.0/24"]
+`,
+		"bad subnet": `
+[Networks]
+    [Networks.1]
+        [[Networks.1.WeightedSubnets]]
+            Weight = 1
+            Subnets = ["192.0.2.0/33"]
+`,
+	}
+
+	for name, config := range configs {
+		path := filepath.Join(t.TempDir(), "phantom_subnets.toml")
+		require.Nil(t, ioutil.WriteFile(path, []byte(config), 0644))
+
+		_, err := SubnetsFromTomlFile(path)
+		require.NotNil(t, err, name)
+	}
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRegistrationRateLimited is returned when a client address has sent more
+// registrations than the configured rate allows. The registration should be dropped.
+var ErrRegistrationRateLimited = errors.New("registration rate limit exceeded for client")
+
+// rateLimitV6Prefix is the prefix length IPv6 clients are limited by, since a
+// single client can usually send from any address in its /64.
+const rateLimitV6Prefix = 64
+
+// rateLimitPruneInterval is how often buckets for clients that have not registered
+// recently are dropped while checking the limit.
+const rateLimitPruneInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// registrationRateLimiter is a token bucket per registering client address. Each
+// bucket holds up to burst registrations and refills at perMinute registrations per
+// minute. A nil *registrationRateLimiter allows everything.
+type registrationRateLimiter struct {
+	perMinute float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	m         sync.Mutex
+}
+
+func newRegistrationRateLimiter(perMinute, burst int) *registrationRateLimiter {
+	if burst < 1 {
+		burst = perMinute
+	}
+	return &registrationRateLimiter{
+		perMinute: float64(perMinute),
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket for addr, returning false if it is empty.
+func (l *registrationRateLimiter) allow(addr net.IP, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if now.Sub(l.lastPrune) >= rateLimitPruneInterval {
+		l.pruneLocked(now)
+	}
+
+	key := rateLimitKey(addr)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refilled(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimitKey returns the bucket key for a client: its address for IPv4 clients and
+// its /64 for IPv6 clients.
+func rateLimitKey(addr net.IP) string {
+	if v4 := addr.To4(); v4 != nil {
+		return v4.String()
+	}
+	return fmt.Sprintf("%s/%d", addr.Mask(net.CIDRMask(rateLimitV6Prefix, 128)), rateLimitV6Prefix)
+}
+
+func (l *registrationRateLimiter) refilled(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Minutes()*l.perMinute
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+// pruneLocked drops buckets that have refilled completely, since a new bucket for
+// the same client would be identical. Assumes the lock is held.
+func (l *registrationRateLimiter) pruneLocked(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refilled(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
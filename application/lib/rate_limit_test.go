@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrationRateLimiter(t *testing.T) {
+	l := newRegistrationRateLimiter(60, 3)
+	client := net.ParseIP("192.0.2.1")
+	other := net.ParseIP("2001:db8::1")
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		require.True(t, l.allow(client, now))
+	}
+	require.False(t, l.allow(client, now))
+
+	// Each client has its own bucket.
+	require.True(t, l.allow(other, now))
+
+	// One registration per second refills.
+	require.True(t, l.allow(client, now.Add(time.Second)))
+	require.False(t, l.allow(client, now.Add(time.Second)))
+
+	// Buckets that have refilled completely are pruned.
+	l.allow(client, now.Add(time.Hour))
+	require.Equal(t, 1, len(l.buckets))
+
+	// IPv6 clients share a bucket per /64.
+	for i := 0; i < 3; i++ {
+		require.True(t, l.allow(net.ParseIP(fmt.Sprintf("2001:db8:0:1::%x", i+1)), now))
+	}
+	require.False(t, l.allow(net.ParseIP("2001:db8:0:1:ffff::1"), now))
+	require.True(t, l.allow(net.ParseIP("2001:db8:0:2::1"), now))
+
+	// A nil limiter allows everything.
+	var disabled *registrationRateLimiter
+	require.True(t, disabled.allow(client, now))
+}
+
+func TestRegistrationRateLimit(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+	rm.SetRegistrationRateLimit(2, 0)
+	require.Nil(t, rm.SetTrustedSources([]string{"198.51.100.0/24"}))
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_API
+
+	client := net.ParseIP("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		_, err = rm.NewRegistration(&c2s, &keys, false, &regSource, client)
+		require.Nil(t, err)
+	}
+	before := atomic.LoadInt64(&Stat().rateLimitedRegistrations)
+	_, err = rm.NewRegistration(&c2s, &keys, false, &regSource, client)
+	require.Equal(t, ErrRegistrationRateLimited, err)
+	require.Equal(t, before+1, atomic.LoadInt64(&Stat().rateLimitedRegistrations))
+
+	c2sw := &pb.C2SWrapper{
+		SharedSecret:        []byte("rate limited secret"),
+		RegistrationPayload: &c2s,
+		RegistrationAddress: []byte(client.To16()),
+	}
+	_, err = rm.NewRegistrationC2SWrapper(c2sw, false)
+	require.Equal(t, ErrRegistrationRateLimited, err)
+
+	// The limit is checked before a phantom is selected, so a registration that could
+	// not select one is still rejected as rate limited.
+	unknownGen, _ := mockReceiveFromDetector()
+	unknownGen.DecoyListGeneration = proto.Uint32(12345)
+	_, err = rm.NewRegistration(&unknownGen, &keys, false, &regSource, client)
+	require.Equal(t, ErrRegistrationRateLimited, err)
+
+	// A registration that is already tracked, e.g. received again through another
+	// decoy, does not use up the client's allowance.
+	other := net.ParseIP("192.0.2.2")
+	reg, err := rm.NewRegistration(&c2s, &keys, false, &regSource, other)
+	require.Nil(t, err)
+	require.Nil(t, rm.TrackRegistration(reg))
+	for i := 0; i < 5; i++ {
+		_, err = rm.NewRegistration(&c2s, &keys, false, &regSource, other)
+		require.Nil(t, err)
+	}
+	otherKeys, err := GenSharedKeys([]byte("another rate limited secret"))
+	require.Nil(t, err)
+	_, err = rm.NewRegistration(&c2s, &otherKeys, false, &regSource, other)
+	require.Nil(t, err)
+	_, err = rm.NewRegistration(&c2s, &otherKeys, false, &regSource, other)
+	require.Equal(t, ErrRegistrationRateLimited, err)
+
+	// Trusted sources and registrations without a client address are not limited.
+	for i := 0; i < 5; i++ {
+		_, err = rm.NewRegistration(&c2s, &keys, false, &regSource, net.ParseIP("198.51.100.7"))
+		require.Nil(t, err)
+		_, err = rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+		require.Nil(t, err)
+	}
+
+	// Disabling the limit allows the client again.
+	rm.SetRegistrationRateLimit(0, 0)
+	_, err = rm.NewRegistration(&c2s, &keys, false, &regSource, client)
+	require.Nil(t, err)
+}
+
+func TestRegistrationRateLimitConcurrent(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	rm.SetRegistrationRateLimit(1, 5)
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_API
+
+	var accepted, limited int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		client := net.ParseIP(fmt.Sprintf("192.0.2.%d", i+1))
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := rm.NewRegistration(&c2s, &keys, false, &regSource, client)
+				if err == ErrRegistrationRateLimited {
+					atomic.AddInt64(&limited, 1)
+				} else if err == nil {
+					atomic.AddInt64(&accepted, 1)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(20*5), accepted)
+	require.Equal(t, int64(20*5), limited)
+}
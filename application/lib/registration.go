@@ -3,14 +3,19 @@ package lib
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -25,6 +30,19 @@ const DETECTOR_REG_CHANNEL string = "dark_decoy_map"
 // station message.
 const AES_GCM_TAG_SIZE = 16
 
+// ErrRegistrationBackpressure is returned when tracking a new registration would grow
+// the registration table beyond the configured limit, typically because registrations
+// are arriving faster than they are expired.
+var ErrRegistrationBackpressure = errors.New("too many tracked registrations")
+
+// ErrRegistrationsPaused is returned by AddRegistration when the manager has been
+// paused and is not accepting new registrations.
+var ErrRegistrationsPaused = errors.New("registration manager is paused")
+
+// ErrPhantomInUse is returned by AddRegistration when publishing is deferred until
+// the liveness check and the phantom is found to be in use.
+var ErrPhantomInUse = errors.New("phantom failed liveness check")
+
 // Transport defines the interface for the manager to interface with variable
 // transports that wrap the traffic sent by clients.
 type Transport interface {
@@ -79,26 +97,148 @@ type ConnectingTransport interface {
 	Connect(context.Context, *DecoyRegistration) (net.Conn, error)
 }
 
+// V6SupportPolicy defines how registrations are handled when the IP version support
+// advertised by the client is inconsistent with the rest of the registration.
+type V6SupportPolicy int
+
+const (
+	// V6SupportRequireConsistent rejects registrations where the client requests a v6
+	// phantom without advertising v6 support, or where an IPv6 client ends up with an
+	// IPv4 phantom. This is the default.
+	V6SupportRequireConsistent V6SupportPolicy = iota
+
+	// V6SupportHonor treats the v6 support advertised by the client as authoritative,
+	// selecting the phantom accordingly and accepting the result.
+	V6SupportHonor
+)
+
+// ParseV6SupportPolicy parses the station config name of a V6SupportPolicy. An
+// empty string selects the default policy.
+func ParseV6SupportPolicy(name string) (V6SupportPolicy, error) {
+	switch name {
+	case "", "require_consistent":
+		return V6SupportRequireConsistent, nil
+	case "honor":
+		return V6SupportHonor, nil
+	default:
+		return V6SupportRequireConsistent, fmt.Errorf("unknown v6 support policy \"%s\"", name)
+	}
+}
+
 // RegistrationManager manages registration tracking for the station.
 type RegistrationManager struct {
 	registeredDecoys *RegisteredDecoys
 	Logger           *log.Logger
 	PhantomSelector  *PhantomIPSelector
+	V6SupportPolicy  V6SupportPolicy
+
+	// ProbeViaDecoy enables probing phantom liveness through the front decoy the
+	// client registered through (using DecoyProbeDialer) instead of dialing the
+	// phantom directly. Registrations without a known decoy are probed directly.
+	// Off by default.
+	ProbeViaDecoy    bool
+	DecoyProbeDialer DecoyDialer
+
+	// DeferDetectorPublish holds back marking new registrations valid and publishing
+	// them to the detector until a liveness probe confirms the phantom is not in use,
+	// including registrations that were pre-scanned by the registrar. Phantoms that
+	// fail the check are never announced. This adds a probe to AddRegistration so it
+	// is off by default.
+	DeferDetectorPublish bool
+
+	// ProbeOnRegistration makes NewRegistrationContext run a liveness check of the
+	// selected phantom, bounded by the context, and reject the registration if the
+	// phantom is in use or the context is done first. Off by default.
+	ProbeOnRegistration bool
+
+	// AcceptHooks are consulted in order once a registration has passed internal
+	// validation in AddRegistration. The first hook to return an error vetoes the
+	// registration. Hooks should be installed before registrations are received.
+	AcceptHooks []AcceptHook
+
+	// RegistrationCodec serializes registrations whenever they are written outside
+	// of the station process. Defaults to gob.
+	RegistrationCodec RegistrationCodec
+
+	// RegistrationTimeout is how long registrations are tracked after they are
+	// received unless a timeout is set for their transport. Defaults to 6 hours
+	// when zero.
+	RegistrationTimeout time.Duration
+
+	// registration sources exempt from rate and capacity limits
+	trustedSources []*net.IPNet
+
+	// per client address registration limit, nil when disabled
+	rateLimiter *registrationRateLimiter
+
+	livenessLimiter *phantomProbeLimiter
+
+	// ports liveness probes are sent to, the registration phantom port if empty
+	probePorts []int
+
+	// number of concurrent liveness probes and how long to wait for them, the
+	// defaults if zero
+	probeWidth   int
+	probeTimeout time.Duration
+
+	observers     []RegistrationObserver
+	registerHooks []RegistrationHook
+	expireHooks   []RegistrationHook
+	observerMutex sync.RWMutex
+	callbacks     *callbackPool
+	callbackOnce  sync.Once
+
+	// paused is non-zero while new registrations are being rejected.
+	paused int32
+}
+
+// AcceptHook is a final veto point allowing external state (quota services, threat
+// feeds, etc.) to reject a registration. A non-nil error vetoes the registration.
+type AcceptHook func(*DecoyRegistration) error
+
+// DecoyDialer dials address by way of the given front decoy. It is used to send
+// liveness probes along the same path a client used when registering.
+type DecoyDialer func(decoy net.IP, network, address string, timeout time.Duration) (net.Conn, error)
+
+// NewRegistrationManager creates a registration manager that shares registrations
+// with the detector through redis using the default settings. An error is returned
+// if the phantom subnets can not be loaded.
+func NewRegistrationManager() (*RegistrationManager, error) {
+	return newRegistrationManager(nil)
+}
+
+// NewRegistrationManagerWithRedis creates a registration manager like
+// NewRegistrationManager that shares registrations with the detector through the
+// redis server described by redisConf.
+func NewRegistrationManagerWithRedis(redisConf RedisConfig) (*RegistrationManager, error) {
+	return newRegistrationManager(&redisConf)
 }
 
-func NewRegistrationManager() *RegistrationManager {
+// newRegistrationManager creates a registration manager publishing to the detector
+// through the redis server described by redisConf, or the default redis publisher
+// if it is nil.
+func newRegistrationManager(redisConf *RedisConfig) (*RegistrationManager, error) {
 	logger := log.New(os.Stdout, "[REG] ", log.Ldate|log.Lmicroseconds)
 
 	p, err := NewPhantomIPSelector()
 	if err != nil {
-		// fmt.Errorf("failed to create the PhantomIPSelector object: %v", err)
-		return nil
+		logger.Printf("failed to create the PhantomIPSelector object: %v", err)
+		return nil, fmt.Errorf("failed to create the PhantomIPSelector object: %v", err)
 	}
-	return &RegistrationManager{
-		Logger:           logger,
-		registeredDecoys: NewRegisteredDecoys(),
-		PhantomSelector:  p,
+
+	registeredDecoys := NewRegisteredDecoys()
+	if redisConf != nil {
+		registeredDecoys.publisher = NewRedisPublisher(*redisConf)
 	}
+
+	return &RegistrationManager{
+		Logger:            logger,
+		registeredDecoys:  registeredDecoys,
+		PhantomSelector:   p,
+		RegistrationCodec: GobRegistrationCodec{},
+		callbacks:         newCallbackPool(defaultCallbackWorkers, defaultCallbackQueue),
+		livenessLimiter:   newPhantomProbeLimiter(DefaultLivenessProbeInterval),
+	}, nil
 }
 
 // AddTransport initializes a transport so that it can be tracked by the manager when
@@ -115,6 +255,7 @@ func (regManager *RegistrationManager) AddTransport(index pb.TransportType, t Tr
 			Logger:           logger,
 			registeredDecoys: NewRegisteredDecoys(),
 			PhantomSelector:  p,
+			livenessLimiter:  newPhantomProbeLimiter(DefaultLivenessProbeInterval),
 		}
 	}
 	if regManager.registeredDecoys == nil {
@@ -144,20 +285,58 @@ func (regManager *RegistrationManager) GetWrappingTransports() map[pb.TransportT
 	return m
 }
 
+// validTransport returns an error if the transport requested by a client is not one
+// the station knows about, rather than letting it default to another transport.
+func validTransport(transport pb.TransportType) error {
+	if _, ok := pb.TransportType_name[int32(transport)]; !ok {
+		return fmt.Errorf("unknown transport %d", transport)
+	}
+	return nil
+}
+
 // NewRegistration creates a new registration from details provided. Adds the registration
 // to tracking map, But marks it as not valid.
-func (regManager *RegistrationManager) NewRegistration(c2s *pb.ClientToStation, conjureKeys *ConjureSharedKeys, includeV6 bool, registrationSource *pb.RegistrationSource) (*DecoyRegistration, error) {
+// clientAddr is the address the registration was sent from, if known. It is used to
+// rate limit registrations and may be nil.
+func (regManager *RegistrationManager) NewRegistration(c2s *pb.ClientToStation, conjureKeys *ConjureSharedKeys, includeV6 bool, registrationSource *pb.RegistrationSource, clientAddr net.IP) (*DecoyRegistration, error) {
+	if err := validTransport(c2s.GetTransport()); err != nil {
+		return nil, err
+	}
+
+	regID := (&DecoyRegistration{Keys: conjureKeys}).IDString()
+
+	bypassLimits, err := regManager.checkLimits(regID, clientAddr, conjureKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	includeV6, err = regManager.applyV6SupportPolicy(regID, c2s, includeV6)
+	if err != nil {
+		return nil, err
+	}
 
-	phantomAddr, err := regManager.PhantomSelector.Select(
+	phantomAddr, phantomSubnet, err := regManager.PhantomSelector.SelectWithSubnet(
 		conjureKeys.DarkDecoySeed, uint(c2s.GetDecoyListGeneration()), includeV6)
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select phantom IP address: %v", err)
 	}
 
+	if err := regManager.checkPhantomFamily(regID, phantomAddr, clientAddr); err != nil {
+		return nil, err
+	}
+
+	var altPhantomAddr net.IP
+	if includeV6 {
+		altPhantomAddr = regManager.selectAltPhantom(conjureKeys.DarkDecoySeed, c2s.GetDecoyListGeneration(), phantomAddr)
+	}
+
 	reg := DecoyRegistration{
 		DarkDecoy:          phantomAddr,
+		AltDarkDecoy:       altPhantomAddr,
+		PhantomSubnet:      phantomSubnet.String(),
 		PhantomPort:        c2s.GetPhantomPort(),
+		registrationAddr:   clientAddr,
 		Keys:               conjureKeys,
 		Covert:             c2s.GetCovertAddress(),
 		Mask:               c2s.GetMaskedDecoyServerName(),
@@ -167,39 +346,85 @@ func (regManager *RegistrationManager) NewRegistration(c2s *pb.ClientToStation,
 		RegistrationTime:   time.Now(),
 		RegistrationSource: registrationSource,
 		regCount:           0,
+		bypassLimits:       bypassLimits,
 	}
 
 	return &reg, nil
 }
 
+// NewRegistrationContext creates a new registration like NewRegistration. If
+// ProbeOnRegistration is set the selected phantom is also checked for liveness with
+// the probe bounded by ctx: registrations whose phantom responds (so is in use) are
+// rejected with ErrPhantomInUse, and if ctx is done before the check completes the
+// outstanding probes are cancelled and the context error is returned.
+func (regManager *RegistrationManager) NewRegistrationContext(ctx context.Context, c2s *pb.ClientToStation, conjureKeys *ConjureSharedKeys, includeV6 bool, registrationSource *pb.RegistrationSource, clientAddr net.IP) (*DecoyRegistration, error) {
+	reg, err := regManager.NewRegistration(c2s, conjureKeys, includeV6, registrationSource, clientAddr)
+	if err != nil || !regManager.ProbeOnRegistration {
+		return reg, err
+	}
+
+	live, response := regManager.PhantomIsLiveContext(ctx, reg)
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("liveness check for %s did not complete: %w", reg.IDString(), err)
+	}
+	if live {
+		Stat().AddLivenessFail()
+		regManager.Logger.Printf("rejecting registration %s -- live phantom: %v", reg.IDString(), response)
+		return nil, ErrPhantomInUse
+	}
+
+	Stat().AddLivenessPass()
+	return reg, nil
+}
+
 // NewRegistrationC2SWrapper creates a new registration from details provided. Adds the registration
 // to tracking map, But marks it as not valid.
 func (regManager *RegistrationManager) NewRegistrationC2SWrapper(c2sw *pb.C2SWrapper, includeV6 bool) (*DecoyRegistration, error) {
 	c2s := c2sw.GetRegistrationPayload()
+	if err := validTransport(c2s.GetTransport()); err != nil {
+		return nil, err
+	}
+
+	clientAddr := net.IP(c2sw.GetRegistrationAddress())
 
 	// Generate keys from shared secret using HKDF
 	conjureKeys, err := GenSharedKeys(c2sw.GetSharedSecret())
+	regID := (&DecoyRegistration{Keys: &conjureKeys}).IDString()
 
-	phantomAddr, err := regManager.PhantomSelector.Select(
+	bypassLimits, err := regManager.checkLimits(regID, clientAddr, &conjureKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	includeV6, err = regManager.applyV6SupportPolicy(regID, c2s, includeV6)
+	if err != nil {
+		return nil, err
+	}
+
+	phantomAddr, phantomSubnet, err := regManager.PhantomSelector.SelectWithSubnet(
 		conjureKeys.DarkDecoySeed, uint(c2s.GetDecoyListGeneration()), includeV6)
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select phantom IP address: %v", err)
 	}
 
-	clientAddr := net.IP(c2sw.GetRegistrationAddress())
+	if err := regManager.checkPhantomFamily(regID, phantomAddr, clientAddr); err != nil {
+		return nil, err
+	}
 
-	if phantomAddr.To4() != nil && clientAddr.To4() == nil {
-		// This can happen if the client chooses from a set that contains no
-		// ipv6 options even if include ipv6 is enabled they will get ipv4.
-		return nil, fmt.Errorf("Failed because IPv6 client chose IPv4 phantom")
+	var altPhantomAddr net.IP
+	if includeV6 {
+		altPhantomAddr = regManager.selectAltPhantom(conjureKeys.DarkDecoySeed, c2s.GetDecoyListGeneration(), phantomAddr)
 	}
 
 	regSrc := c2sw.GetRegistrationSource()
 	reg := DecoyRegistration{
 		DarkDecoy:          phantomAddr,
+		AltDarkDecoy:       altPhantomAddr,
+		PhantomSubnet:      phantomSubnet.String(),
 		PhantomPort:        c2s.GetPhantomPort(),
-		registrationAddr:   net.IP(c2sw.GetRegistrationAddress()),
+		registrationAddr:   clientAddr,
+		DecoyAddr:          net.IP(c2sw.GetDecoyAddress()),
 		Keys:               &conjureKeys,
 		Covert:             c2s.GetCovertAddress(),
 		Mask:               c2s.GetMaskedDecoyServerName(),
@@ -209,11 +434,132 @@ func (regManager *RegistrationManager) NewRegistrationC2SWrapper(c2sw *pb.C2SWra
 		RegistrationTime:   time.Now(),
 		RegistrationSource: &regSrc,
 		regCount:           0,
+		bypassLimits:       bypassLimits,
 	}
 
 	return &reg, nil
 }
 
+// applyV6SupportPolicy returns whether a v6 phantom should be selected for a
+// registration that asks for one (includeV6), applying V6SupportPolicy if the client
+// does not advertise v6 support.
+func (regManager *RegistrationManager) applyV6SupportPolicy(regID string, c2s *pb.ClientToStation, includeV6 bool) (bool, error) {
+	if !includeV6 || c2s.GetV6Support() {
+		return includeV6, nil
+	}
+
+	if regManager.V6SupportPolicy != V6SupportHonor {
+		regManager.Logger.Printf("v6 support policy rejected %s: v6 phantom requested for client without v6 support", regID)
+		return false, fmt.Errorf("Failed because v6 phantom requested for client without v6 support")
+	}
+	regManager.Logger.Printf("v6 support policy honoring client v6 support for %s: selecting v4 phantom", regID)
+	return false, nil
+}
+
+// checkPhantomFamily applies V6SupportPolicy to an IPv6 client that was given an
+// IPv4 phantom. Nothing is checked if the client address is not known.
+func (regManager *RegistrationManager) checkPhantomFamily(regID string, phantomAddr, clientAddr net.IP) error {
+	if len(clientAddr) == 0 || phantomAddr.To4() == nil || clientAddr.To4() != nil {
+		return nil
+	}
+
+	// This can happen if the client chooses from a set that contains no
+	// ipv6 options even if include ipv6 is enabled they will get ipv4.
+	if regManager.V6SupportPolicy != V6SupportHonor {
+		regManager.Logger.Printf("v6 support policy rejected %s: IPv6 client chose IPv4 phantom", regID)
+		return fmt.Errorf("Failed because IPv6 client chose IPv4 phantom")
+	}
+	regManager.Logger.Printf("v6 support policy honoring client v6 support for %s: IPv6 client chose IPv4 phantom", regID)
+	return nil
+}
+
+// selectAltPhantom returns the phantom a client without v6 support would select,
+// offered as a fallback to clients that support both address families when their
+// phantom is v6. Returns nil if primary is already a v4 address or no v4 phantom is
+// available.
+func (regManager *RegistrationManager) selectAltPhantom(seed []byte, generation uint32, primary net.IP) net.IP {
+	if primary.To4() != nil {
+		return nil
+	}
+
+	// Generations without v4 subnets are expected, so do not count them as empty
+	// pools.
+	if !regManager.PhantomSelector.hasV4Subnets(seed, uint(generation)) {
+		return nil
+	}
+
+	alt, err := regManager.PhantomSelector.Select(seed, uint(generation), false)
+	if err != nil {
+		return nil
+	}
+	return alt
+}
+
+// SetTrustedSources sets the subnets (in CIDR notation) of registration sources,
+// such as internal health checks, that are not subject to rate or capacity limits.
+func (regManager *RegistrationManager) SetTrustedSources(subnets []string) error {
+	trusted := []*net.IPNet{}
+	for _, subnet := range subnets {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("failed to parse trusted source subnet: %v", err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+
+	regManager.trustedSources = trusted
+	return nil
+}
+
+// SetRegistrationRateLimit limits each client address to perMinute registrations per
+// minute, allowing bursts of up to burst registrations (perMinute if burst is 0).
+// Registrations over the limit are rejected with ErrRegistrationRateLimited.
+// Registrations from trusted sources or without a known client address are not
+// limited. A perMinute of 0 disables the limit. The limit should be set before
+// registrations are received.
+func (regManager *RegistrationManager) SetRegistrationRateLimit(perMinute, burst int) {
+	if perMinute <= 0 {
+		regManager.rateLimiter = nil
+		return
+	}
+	regManager.rateLimiter = newRegistrationRateLimiter(perMinute, burst)
+}
+
+// checkLimits returns whether a registration sent from clientAddr bypasses rate and
+// capacity limits because it comes from a trusted source, or ErrRegistrationRateLimited
+// if the client has used up its registration rate limit. It is called before a
+// phantom is selected so that registrations over the limit are rejected as cheaply as
+// possible. Registrations whose shared secret is already tracked are not counted
+// again.
+func (regManager *RegistrationManager) checkLimits(regID string, clientAddr net.IP, keys *ConjureSharedKeys) (bool, error) {
+	if regManager.isTrustedSource(clientAddr) {
+		// Trusted sources skip rate and capacity limits, but not validation.
+		regManager.Logger.Printf("registration %s from trusted source bypasses limits", regID)
+		return true, nil
+	}
+	if isUnspecifiedAddr(clientAddr) || regManager.rateLimiter == nil {
+		return false, nil
+	}
+	if regManager.registeredDecoys.secretTracked(keys.SharedSecret) {
+		// The same registration received again, e.g. through several decoys.
+		return false, nil
+	}
+	if !regManager.rateLimiter.allow(clientAddr, time.Now()) {
+		Stat().AddRateLimitedReg()
+		return false, ErrRegistrationRateLimited
+	}
+	return false, nil
+}
+
+func (regManager *RegistrationManager) isTrustedSource(addr net.IP) bool {
+	for _, subnet := range regManager.trustedSources {
+		if subnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // TrackRegistration adds the registration to the map WITHOUT marking it valid.
 func (regManager *RegistrationManager) TrackRegistration(d *DecoyRegistration) error {
 	err := regManager.registeredDecoys.Track(d)
@@ -223,16 +569,84 @@ func (regManager *RegistrationManager) TrackRegistration(d *DecoyRegistration) e
 	return nil
 }
 
+// registrationIsNew returns true unless a valid registration with the same secret
+// and phantom is already tracked.
+func (regManager *RegistrationManager) registrationIsNew(d *DecoyRegistration) bool {
+	existing := regManager.registeredDecoys.RegistrationExists(d)
+	return existing == nil || !existing.Valid
+}
+
 // AddRegistration officially adds the registration to usage by marking it as valid.
-func (regManager *RegistrationManager) AddRegistration(d *DecoyRegistration) {
+// While the manager is paused new registrations are rejected with ErrRegistrationsPaused.
+// New registrations must also be accepted by every AcceptHook and, if
+// DeferDetectorPublish is set, pass a liveness check before they are published.
+func (regManager *RegistrationManager) AddRegistration(d *DecoyRegistration) error {
+	isNew := regManager.registrationIsNew(d)
+
+	if isNew && regManager.Paused() {
+		return ErrRegistrationsPaused
+	}
+
+	if isNew {
+		for _, hook := range regManager.AcceptHooks {
+			if err := hook(d); err != nil {
+				Stat().AddVetoedReg()
+				regManager.Logger.Printf("registration %s vetoed by accept hook: %v", d.IDString(), err)
+				return fmt.Errorf("registration vetoed: %w", err)
+			}
+		}
+	}
+
+	if isNew && regManager.DeferDetectorPublish {
+		live, response := regManager.PhantomIsLive(d)
+		if live {
+			Stat().AddLivenessFail()
+			regManager.Logger.Printf("not publishing registration %s -- live phantom: %v", d.IDString(), response)
+			return ErrPhantomInUse
+		}
+	}
+
+	if isNew {
+		if collisions := regManager.registeredDecoys.phantomCollisions(d); collisions > 0 {
+			regManager.Logger.Printf("WARNING phantom selection collision: %s shares phantom %s with %d other secrets",
+				d.IDString(), d.DarkDecoy, collisions)
+		}
+	}
 
 	darkDecoyAddr := d.DarkDecoy.String()
 	err := regManager.registeredDecoys.register(darkDecoyAddr, d)
 	if err != nil {
 		regManager.Logger.Printf("Error registering decoy: %s", err)
+		return err
+	}
+
+	if isNew {
+		regManager.runHooks(EventRegister, d)
+		regManager.notifyObservers(EventRegister, d)
+	}
+	return nil
+}
+
+// Pause stops the manager from accepting new registrations. Existing registrations
+// continue to be served and expired as normal.
+func (regManager *RegistrationManager) Pause() {
+	if atomic.SwapInt32(&regManager.paused, 1) == 0 {
+		regManager.Logger.Printf("pausing acceptance of new registrations")
+	}
+}
+
+// Resume allows the manager to accept new registrations again after Pause.
+func (regManager *RegistrationManager) Resume() {
+	if atomic.SwapInt32(&regManager.paused, 0) == 1 {
+		regManager.Logger.Printf("resuming acceptance of new registrations")
 	}
 }
 
+// Paused returns true if the manager is currently rejecting new registrations.
+func (regManager *RegistrationManager) Paused() bool {
+	return atomic.LoadInt32(&regManager.paused) == 1
+}
+
 // RegistrationExists checks if the registration is already tracked by the manager, this is
 // independent of the validity tag, this just checks to see if the registration exists.
 func (regManager *RegistrationManager) RegistrationExists(reg *DecoyRegistration) bool {
@@ -240,6 +654,65 @@ func (regManager *RegistrationManager) RegistrationExists(reg *DecoyRegistration
 	return trackedReg != nil
 }
 
+// UpdateCovert replaces the covert address of the registration(s) created from the
+// given shared secret in place, leaving the phantom, keys and detector state untouched.
+// Returns an error if the new covert address is malformed or no registration matches.
+func (regManager *RegistrationManager) UpdateCovert(secret []byte, newCovert string) error {
+	host, port, err := net.SplitHostPort(newCovert)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("malformed covert address \"%s\"", newCovert)
+	}
+
+	return regManager.registeredDecoys.updateCovert(secret, newCovert)
+}
+
+// MigrateGeneration re-maps every tracked registration from generation oldGen to a
+// phantom selected from generation newGen, keeping its keys, covert address and age.
+// Valid registrations are re-published to the detector under their new phantom.
+// Returns the number of registrations migrated. Registrations that could not be
+// migrated are left in the old generation and reported together in the error.
+func (regManager *RegistrationManager) MigrateGeneration(oldGen, newGen uint) (int, error) {
+	if oldGen == newGen {
+		return 0, fmt.Errorf("cannot migrate generation %d to itself", oldGen)
+	}
+	if regManager.PhantomSelector.GetSubnetsByGeneration(newGen) == nil {
+		return 0, fmt.Errorf("unknown generation %d", newGen)
+	}
+
+	selectPhantom := func(reg *DecoyRegistration) (net.IP, *net.IPNet, net.IP, error) {
+		v6 := reg.DarkDecoy.To4() == nil
+		phantom, subnet, err := regManager.PhantomSelector.SelectWithSubnet(reg.Keys.DarkDecoySeed, newGen, v6)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		var alt net.IP
+		if reg.AltDarkDecoy != nil {
+			alt = regManager.selectAltPhantom(reg.Keys.DarkDecoySeed, uint32(newGen), phantom)
+		}
+		return phantom, subnet, alt, nil
+	}
+
+	migrated, failures := regManager.registeredDecoys.migrateGeneration(uint32(oldGen), uint32(newGen), selectPhantom)
+	regManager.Logger.Printf("migrated %d registrations from generation %d to %d (%d failed)", migrated, oldGen, newGen, len(failures))
+	if len(failures) > 0 {
+		msgs := make([]string, 0, len(failures))
+		for _, err := range failures {
+			msgs = append(msgs, err.Error())
+		}
+		return migrated, fmt.Errorf("failed to migrate %d registrations from generation %d: %s", len(failures), oldGen, strings.Join(msgs, "; "))
+	}
+	return migrated, nil
+}
+
+// FindByCovert returns copies of all tracked registrations (valid or not) whose
+// covert address is covert, so they can be read while the registrations are updated.
+// This scans the registration table so it is intended for investigation rather than
+// the connection handling path.
+func (regManager *RegistrationManager) FindByCovert(covert string) []*DecoyRegistration {
+	return regManager.registeredDecoys.findByCovert(covert)
+}
+
 // GetRegistrations returns registrations associated with a specific phantom address.
 func (regManager *RegistrationManager) GetRegistrations(phantomAddr net.IP) map[string]*DecoyRegistration {
 	return regManager.registeredDecoys.getRegistrations(phantomAddr)
@@ -251,14 +724,265 @@ func (regManager *RegistrationManager) CountRegistrations(phantomAddr net.IP) in
 	return regManager.registeredDecoys.countRegistrations(phantomAddr)
 }
 
+// TotalRegistrations returns the number of registrations currently tracked. Use
+// CountRegistrations for the registrations using a single phantom address, or Stats
+// for a fuller summary.
+func (regManager *RegistrationManager) TotalRegistrations() int {
+	return regManager.registeredDecoys.TotalRegistrations()
+}
+
+// RegistrationsByFamily returns the number of registrations currently tracked with
+// v4 and with v6 phantom addresses.
+func (regManager *RegistrationManager) RegistrationsByFamily() (v4, v6 int) {
+	return regManager.registeredDecoys.countByFamily()
+}
+
 // RemoveOldRegistrations garbage collects old registrations
 func (regManager *RegistrationManager) RemoveOldRegistrations() {
-	regManager.registeredDecoys.removeOldRegistrations(regManager.Logger)
+	expired := regManager.registeredDecoys.removeOldRegistrations(regManager.Logger, regManager.RegistrationTimeout)
+	for _, reg := range expired {
+		regManager.notifyExpired(reg)
+	}
+
+	if regManager.livenessLimiter != nil {
+		regManager.livenessLimiter.prune()
+	}
+}
+
+// Run expires old registrations every interval until ctx is cancelled. It blocks, so
+// it is usually started in its own goroutine.
+func (regManager *RegistrationManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			regManager.RemoveOldRegistrations()
+		}
+	}
+}
+
+// SetIDCollisionPrefixLen sets the number of hex characters of the shared secret
+// compared when warning about registration id collisions. Defaults to the length of
+// the id used in logs.
+func (regManager *RegistrationManager) SetIDCollisionPrefixLen(n int) {
+	regManager.registeredDecoys.SetIDCollisionPrefixLen(n)
+}
+
+// SetMaxTrackedRegistrations limits the number of registrations tracked at once. Once
+// the limit is reached new registrations are rejected with ErrRegistrationBackpressure
+// until old registrations are expired. A limit of 0 disables the check.
+func (regManager *RegistrationManager) SetMaxTrackedRegistrations(n int) {
+	regManager.registeredDecoys.m.Lock()
+	defer regManager.registeredDecoys.m.Unlock()
+
+	regManager.registeredDecoys.maxTracked = n
+}
+
+// SetDetectorEncoding selects the encoding used when sharing registrations with the
+// detector. This should be set before registrations are added.
+func (regManager *RegistrationManager) SetDetectorEncoding(encoding DetectorEncoding) {
+	regManager.registeredDecoys.m.Lock()
+	defer regManager.registeredDecoys.m.Unlock()
+
+	regManager.registeredDecoys.detectorEncoding = encoding
+}
+
+// SetDetectorPublisher selects how registration events are shared with the detector.
+// Registrations are published over redis by default, and setting a nil publisher
+// restores the default.
+func (regManager *RegistrationManager) SetDetectorPublisher(publisher DetectorPublisher) {
+	regManager.registeredDecoys.m.Lock()
+	defer regManager.registeredDecoys.m.Unlock()
+
+	if publisher == nil {
+		publisher = redisPublisher{}
+	}
+
+	regManager.registeredDecoys.publisher = publisher
+}
+
+// SetTransportTimeout sets how long registrations using the given transport are
+// tracked before they expire. A timeout of 0 restores the default.
+func (regManager *RegistrationManager) SetTransportTimeout(transport pb.TransportType, timeout time.Duration) {
+	regManager.registeredDecoys.m.Lock()
+	defer regManager.registeredDecoys.m.Unlock()
+
+	if timeout <= 0 {
+		delete(regManager.registeredDecoys.transportTimeouts, transport)
+		return
+	}
+	regManager.registeredDecoys.transportTimeouts[transport] = timeout
+}
+
+// SetBatchExpiryNotifications enables coalescing the expiry events from each eviction
+// tick into a single message to the detector. This only applies if the detector
+// publisher supports batches, otherwise expiry events are published individually.
+func (regManager *RegistrationManager) SetBatchExpiryNotifications(enabled bool) {
+	regManager.registeredDecoys.m.Lock()
+	defer regManager.registeredDecoys.m.Unlock()
+
+	regManager.registeredDecoys.batchExpiry = enabled
+}
+
+// SetLivenessProbeInterval sets the minimum time between liveness probes sent to
+// any single phantom address. An interval of zero disables caching unless cache TTLs
+// are set: every check then sends a fresh probe, sharing only probes still in flight.
+func (regManager *RegistrationManager) SetLivenessProbeInterval(interval time.Duration) {
+	if regManager.livenessLimiter == nil {
+		regManager.livenessLimiter = newPhantomProbeLimiter(interval)
+		return
+	}
+	regManager.livenessLimiter.setInterval(interval)
+}
+
+// SetLivenessProbePorts sets the ports liveness probes are sent to. A phantom is live
+// if it responds on any of them. Probes are sent to the phantom port of the
+// registration (443 unless the client requested otherwise) if no ports are set.
+func (regManager *RegistrationManager) SetLivenessProbePorts(ports []int) error {
+	for _, port := range ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid liveness probe port %d", port)
+		}
+	}
+	regManager.probePorts = append([]int(nil), ports...)
+	return nil
+}
+
+// SetLivenessCacheTTLs sets how long completed liveness results are reused for a
+// phantom address, separately for phantoms found live and not live. A zero TTL uses
+// the liveness probe interval.
+func (regManager *RegistrationManager) SetLivenessCacheTTLs(live, dead time.Duration) {
+	if regManager.livenessLimiter == nil {
+		regManager.livenessLimiter = newPhantomProbeLimiter(DefaultLivenessProbeInterval)
+	}
+	regManager.livenessLimiter.setTTLs(live, dead)
+}
+
+// PhantomIsLive tests whether the phantoms of a registration are live. Probes are
+// limited per phantom address so registrations sharing a phantom within the
+// probe interval share a single probe result. A registration carrying both a v6
+// and a v4 phantom is live if either of them is.
+func (regManager *RegistrationManager) PhantomIsLive(reg *DecoyRegistration) (bool, error) {
+	return regManager.PhantomIsLiveContext(context.Background(), reg)
+}
+
+// PhantomIsLiveContext is PhantomIsLive bounded by ctx. If ctx is done before the
+// probes finish they are cancelled and ctx.Err() is returned.
+func (regManager *RegistrationManager) PhantomIsLiveContext(ctx context.Context, reg *DecoyRegistration) (bool, error) {
+	var live bool
+	var err error
+	for _, phantom := range reg.phantoms() {
+		live, err = regManager.phantomIsLive(ctx, reg, phantom)
+		if live || ctx.Err() != nil {
+			return live, err
+		}
+	}
+	return live, err
+}
+
+func (regManager *RegistrationManager) phantomIsLive(ctx context.Context, reg *DecoyRegistration, phantom net.IP) (bool, error) {
+	addresses := regManager.probeAddresses(reg, phantom)
+	width, timeout := regManager.probeOptions()
+
+	// The probe covers every configured port; the address passed in by the limiter
+	// is only the first of them.
+	probe := func(string) (bool, error) {
+		return probeWithContext(ctx, addresses, probeDialContext, width, timeout)
+	}
+	if regManager.ProbeViaDecoy && regManager.DecoyProbeDialer != nil && !isUnspecifiedAddr(reg.DecoyAddr) {
+		// Probe along the same front decoy path the client used to register.
+		decoy := reg.DecoyAddr
+		dial := ignoreContext(func(network, address string, timeout time.Duration) (net.Conn, error) {
+			return regManager.DecoyProbeDialer(decoy, network, address, timeout)
+		})
+		probe = func(string) (bool, error) {
+			return phantomIsLiveDialContext(ctx, addresses, dial, width, timeout)
+		}
+	}
+	address := addresses[0]
+
+	if metrics := regManager.metrics(); metrics != nil {
+		timed := probe
+		probe = func(address string) (bool, error) {
+			start := time.Now()
+			live, err := timed(address)
+			metrics.livenessProbe(live, time.Since(start))
+			return live, err
+		}
+	}
+
+	if regManager.livenessLimiter == nil {
+		return probe(address)
+	}
+	return regManager.livenessLimiter.checkContext(ctx, phantom, address, probe)
+}
+
+// SetLivenessProbeOptions sets the number of concurrent probes (SYNs) sent when
+// testing whether a phantom is live and how long to wait for a response. Zero values
+// select the defaults of 4 probes and 750ms. When probing several ports at least one
+// probe is sent to each.
+func (regManager *RegistrationManager) SetLivenessProbeOptions(width int, timeout time.Duration) {
+	regManager.probeWidth = width
+	regManager.probeTimeout = timeout
+}
+
+func (regManager *RegistrationManager) probeOptions() (int, time.Duration) {
+	width, timeout := regManager.probeWidth, regManager.probeTimeout
+	if width <= 0 {
+		width = defaultProbeWidth
+	}
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	return width, timeout
+}
+
+// probeAddresses returns the addresses (host:port) liveness probes of phantom are
+// sent to: the configured probe ports if any, otherwise the phantom port of the
+// registration.
+func (regManager *RegistrationManager) probeAddresses(reg *DecoyRegistration, phantom net.IP) []string {
+	ports := regManager.probePorts
+	if len(ports) == 0 {
+		port := int(reg.PhantomPort)
+		if port == 0 {
+			port = defaultProbePort
+		}
+		ports = []int{port}
+	}
+
+	addresses := make([]string, len(ports))
+	for i, port := range ports {
+		addresses[i] = net.JoinHostPort(phantom.String(), strconv.Itoa(port))
+	}
+	return addresses
+}
+
+// metrics returns the Prometheus collectors for the manager, nil if they have not been
+// registered.
+func (regManager *RegistrationManager) metrics() *registrationMetrics {
+	if regManager.registeredDecoys == nil {
+		return nil
+	}
+
+	regManager.registeredDecoys.m.RLock()
+	defer regManager.registeredDecoys.m.RUnlock()
+	return regManager.registeredDecoys.metrics
+}
+
+func isUnspecifiedAddr(addr net.IP) bool {
+	return len(addr) == 0 || addr.IsUnspecified()
 }
 
 // DecoyRegistration is a struct for tracking individual sessions that are expecting or tracking connections.
 type DecoyRegistration struct {
 	DarkDecoy          net.IP
+	AltDarkDecoy       net.IP // v4 phantom offered as a fallback alongside a v6 DarkDecoy, if any
+	PhantomSubnet      string // configured subnet the phantom was selected from
+	DecoyAddr          net.IP // front decoy the registration was received through, if known
 	PhantomPort        uint32
 	registrationAddr   net.IP
 	Keys               *ConjureSharedKeys
@@ -270,22 +994,39 @@ type DecoyRegistration struct {
 	DecoyListVersion   uint32
 	regCount           int32
 
+	// bypassLimits marks registrations from trusted sources that are exempt from
+	// rate and capacity limits.
+	bypassLimits bool
+
+	// selfTest marks the synthetic registration added by SelfTest, which is never
+	// shared with the detector.
+	selfTest bool
+
 	// validity marks whether the registration has been validated through liveness and other checks.
 	// This also denotes whether the registration has been shared with the detector.
 	Valid bool
 }
 
+// nilRegistrationString is the digest printed for a nil registration.
+const nilRegistrationString = "<nil registration>"
+
 // String -- Print a digest of the important identifying information for this registration.
 //[TODO]{priority:soon} Find a way to add the client IP to this logging for now it is logged
 // in the detector associating registrant IP with shared secret.
 func (reg *DecoyRegistration) String() string {
 	if reg == nil {
-		return "{}"
+		return nilRegistrationString
+	}
+
+	var altPhantom string
+	if reg.AltDarkDecoy != nil {
+		altPhantom = reg.AltDarkDecoy.String()
 	}
 
 	stats := struct {
 		Phantom          string
-		SharedSecret     string
+		AltPhantom       string `json:",omitempty"`
+		RegID            string
 		Covert, Mask     string
 		Flags            *pb.RegistrationFlags
 		Transport        pb.TransportType
@@ -294,7 +1035,8 @@ func (reg *DecoyRegistration) String() string {
 		Source           *pb.RegistrationSource
 	}{
 		Phantom:          reg.DarkDecoy.String(),
-		SharedSecret:     hex.EncodeToString(reg.Keys.SharedSecret),
+		AltPhantom:       altPhantom,
+		RegID:            reg.IDString(),
 		Mask:             reg.Mask,
 		Flags:            reg.Flags,
 		Transport:        reg.Transport,
@@ -304,22 +1046,160 @@ func (reg *DecoyRegistration) String() string {
 	}
 	regStats, err := json.Marshal(stats)
 	if err != nil {
-		return fmt.Sprintf("%v", reg.String())
+		// Fall back to the id rather than recursing back into String.
+		return fmt.Sprintf("{RegID: %s}", stats.RegID)
 	}
 	return string(regStats)
 }
 
-// Length of the registration ID for logging
-var regIDLen = 16
+// FullDigest -- Print a digest of the registration including the full shared secret and
+// client address. This must never be written to the main logs; it is only served over
+// the access controlled debug socket.
+func (reg *DecoyRegistration) FullDigest() string {
+	if reg == nil {
+		return "{}"
+	}
 
-// IDString - return a short version of the id (HMAC-ID) of a registration for logging
-func (reg *DecoyRegistration) IDString() string {
-	var xid []string
+	var sharedSecret string
+	if reg.Keys != nil {
+		sharedSecret = hex.EncodeToString(reg.Keys.SharedSecret)
+	}
 
-	for i := 0; i < regIDLen; i++ {
-		xid = append(xid, "0")
+	var altPhantom string
+	if reg.AltDarkDecoy != nil {
+		altPhantom = reg.AltDarkDecoy.String()
 	}
-	nilID := strings.Join(xid, "")
+
+	digest := struct {
+		Phantom          string
+		AltPhantom       string `json:",omitempty"`
+		PhantomPort      uint32
+		SharedSecret     string
+		ClientAddr       string
+		Covert, Mask     string
+		Flags            *pb.RegistrationFlags
+		Transport        pb.TransportType
+		RegTime          time.Time
+		DecoyListVersion uint32
+		Source           *pb.RegistrationSource
+		Valid            bool
+	}{
+		Phantom:          reg.DarkDecoy.String(),
+		AltPhantom:       altPhantom,
+		PhantomPort:      reg.PhantomPort,
+		SharedSecret:     sharedSecret,
+		ClientAddr:       reg.registrationAddr.String(),
+		Covert:           reg.Covert,
+		Mask:             reg.Mask,
+		Flags:            reg.Flags,
+		Transport:        reg.Transport,
+		RegTime:          reg.RegistrationTime,
+		DecoyListVersion: reg.DecoyListVersion,
+		Source:           reg.RegistrationSource,
+		Valid:            reg.Valid,
+	}
+	out, err := json.Marshal(digest)
+	if err != nil {
+		return "{}"
+	}
+	return string(out)
+}
+
+// RegistrationStatus is the view of a registration served by status and debug
+// endpoints. It never carries the full shared secret or the keys derived from it,
+// but the registration id (RegID) is the hex encoded first 8 bytes of the secret,
+// the same id used in the logs.
+type RegistrationStatus struct {
+	RegID       string    `json:"reg_id"`
+	Phantom     string    `json:"phantom"`
+	AltPhantom  string    `json:"alt_phantom,omitempty"`
+	PhantomPort uint32    `json:"phantom_port"`
+	Covert      string    `json:"covert"`
+	Mask        string    `json:"mask"`
+	Flags       string    `json:"flags,omitempty"` // hex encoded protobuf RegistrationFlags
+	Transport   string    `json:"transport"`
+	Generation  uint32    `json:"generation"`
+	Source      string    `json:"source,omitempty"`
+	RegTime     time.Time `json:"reg_time"`
+	RegCount    int32     `json:"reg_count"`
+	Valid       bool      `json:"valid"`
+}
+
+// ToStatus returns the status view of the registration.
+func (reg *DecoyRegistration) ToStatus() RegistrationStatus {
+	status := RegistrationStatus{
+		RegID:       reg.IDString(),
+		Phantom:     reg.DarkDecoy.String(),
+		PhantomPort: reg.PhantomPort,
+		Covert:      reg.Covert,
+		Mask:        reg.Mask,
+		Transport:   reg.Transport.String(),
+		Generation:  reg.DecoyListVersion,
+		RegTime:     reg.RegistrationTime,
+		RegCount:    reg.regCount,
+		Valid:       reg.Valid,
+	}
+	if reg.AltDarkDecoy != nil {
+		status.AltPhantom = reg.AltDarkDecoy.String()
+	}
+	if reg.Flags != nil {
+		if flags, err := proto.Marshal(reg.Flags); err == nil {
+			status.Flags = hex.EncodeToString(flags)
+		}
+	}
+	if reg.RegistrationSource != nil {
+		status.Source = reg.RegistrationSource.String()
+	}
+	return status
+}
+
+// MarshalJSON encodes the registration as its RegistrationStatus so that the shared
+// secret is never included when a registration is serialized as JSON.
+func (reg *DecoyRegistration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(reg.ToStatus())
+}
+
+// Fingerprint returns a stable identifier for the registration derived only from its
+// shared secret, phantom address and generation, so that the same registration yields
+// the same fingerprint across receipts and station restarts.
+func (reg *DecoyRegistration) Fingerprint() [32]byte {
+	h := sha256.New()
+	h.Write([]byte("conjure registration fingerprint v1"))
+
+	var secret []byte
+	if reg.Keys != nil {
+		secret = reg.Keys.SharedSecret
+	}
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(len(secret)))
+	h.Write(buf[:])
+	h.Write(secret)
+
+	phantom := reg.DarkDecoy.To16()
+	if phantom == nil {
+		phantom = make(net.IP, net.IPv6len)
+	}
+	h.Write(phantom)
+
+	binary.BigEndian.PutUint32(buf[:], reg.DecoyListVersion)
+	h.Write(buf[:])
+
+	var fp [32]byte
+	copy(fp[:], h.Sum(nil))
+	return fp
+}
+
+// Length of the registration ID for logging
+var regIDLen = 16
+
+// IDString - return a short version of the id (HMAC-ID) of a registration for logging
+func (reg *DecoyRegistration) IDString() string {
+	var xid []string
+
+	for i := 0; i < regIDLen; i++ {
+		xid = append(xid, "0")
+	}
+	nilID := strings.Join(xid, "")
 
 	if reg == nil || reg.Keys == nil {
 
@@ -393,20 +1273,77 @@ func (reg *DecoyRegistration) PreScanned() bool {
 // see  ZMap: Fast Internet-wide Scanning  and Its Security Applications
 // https://www.usenix.org/system/files/conference/usenixsecurity13/sec13-paper_durumeric.pdf
 //
+// If the registration carries both a v6 and a v4 phantom it is live if either is.
+//
 // return:	bool	true  - host is live
 // 					false - host is not live
 //			error	reason decision was made
 func (reg *DecoyRegistration) PhantomIsLive() (bool, error) {
-	return phantomIsLive(net.JoinHostPort(reg.DarkDecoy.String(), fmt.Sprint(reg.PhantomPort)))
+	var live bool
+	var err error
+	for _, phantom := range reg.phantoms() {
+		live, err = phantomIsLive(net.JoinHostPort(phantom.String(), fmt.Sprint(reg.PhantomPort)))
+		if live {
+			return live, err
+		}
+	}
+	return live, err
+}
+
+// phantoms returns the phantom addresses a client may connect to for this
+// registration, starting with DarkDecoy.
+func (reg *DecoyRegistration) phantoms() []net.IP {
+	if reg.AltDarkDecoy == nil {
+		return []net.IP{reg.DarkDecoy}
+	}
+	return []net.IP{reg.DarkDecoy, reg.AltDarkDecoy}
 }
 
 func phantomIsLive(address string) (bool, error) {
-	width := 4
+	return probeWithContext(context.Background(), []string{address}, probeDialContext, defaultProbeWidth, defaultProbeTimeout)
+}
+
+// livenessDialer dials a liveness probe connection, matching net.DialTimeout.
+type livenessDialer func(network, address string, timeout time.Duration) (net.Conn, error)
+
+// livenessContextDialer is a livenessDialer that gives up once ctx is done.
+type livenessContextDialer func(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error)
+
+// ignoreContext adapts a dialer without context support. Dials it has started run
+// until their own timeout even if the probe is cancelled.
+func ignoreContext(dial livenessDialer) livenessContextDialer {
+	return func(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+		return dial(network, address, timeout)
+	}
+}
+
+func phantomIsLiveDial(address string, dial livenessDialer) (bool, error) {
+	return phantomIsLiveDialAny([]string{address}, dial)
+}
+
+// phantomIsLiveDialAny probes addresses with the default probe width and timeout.
+func phantomIsLiveDialAny(addresses []string, dial livenessDialer) (bool, error) {
+	return phantomIsLiveDialContext(context.Background(), addresses, ignoreContext(dial), defaultProbeWidth, defaultProbeTimeout)
+}
+
+// phantomIsLiveDialContext sends width concurrent liveness probes for a phantom
+// spread across addresses (the same host on different ports), treating the phantom
+// as live if it responds on any of them within timeout. Every address is probed at
+// least once. If ctx is done first the probe stops early, cancelling any dials still
+// outstanding, and returns ctx.Err().
+func phantomIsLiveDialContext(ctx context.Context, addresses []string, dial livenessContextDialer, width int, timeout time.Duration) (bool, error) {
+	if width < len(addresses) {
+		width = len(addresses)
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Buffered so that probes finishing after a decision is made never block.
 	dialError := make(chan error, width)
-	timeout := 750 * time.Millisecond
 
-	testConnect := func() {
-		conn, err := net.DialTimeout("tcp", address, timeout)
+	testConnect := func(address string) {
+		conn, err := dial(probeCtx, "tcp", address, timeout)
 		if err != nil {
 			dialError <- err
 			return
@@ -416,24 +1353,48 @@ func phantomIsLive(address string) (bool, error) {
 	}
 
 	for i := 0; i < width; i++ {
-		go testConnect()
+		go testConnect(addresses[i%len(addresses)])
 	}
 
-	time.Sleep(timeout)
-
-	// If any return errors or connect then return nil before deadline it is live
-	select {
-	case err := <-dialError:
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			return false, fmt.Errorf("Reached connection timeout")
-		}
-		if err != nil {
-			return true, err
+	// Collect results until a probe connects or the window closes. A probe that
+	// connects marks the phantom live. Any other response (e.g. a reset) also shows
+	// that something is using the address, so it is live unless every probe
+	// times out.
+	var responded error
+	for i := 0; i < width; i++ {
+		select {
+		case err := <-dialError:
+			if err == nil {
+				return true, fmt.Errorf("Phantom picked up the connection")
+			}
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			if probeCtx.Err() != nil {
+				// cut short by the window closing or cancellation, not a response
+				continue
+			}
+			if responded == nil {
+				responded = err
+			}
+		case <-probeCtx.Done():
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+			if responded != nil {
+				return true, responded
+			}
+			return false, fmt.Errorf("Reached statistical timeout %v", timeout)
 		}
-		return true, fmt.Errorf("Phantom picked up the connection")
-	default:
-		return false, fmt.Errorf("Reached statistical timeout %v", timeout)
 	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if responded != nil {
+		return true, responded
+	}
+	return false, fmt.Errorf("Reached connection timeout")
 }
 
 type DecoyTimeout struct {
@@ -441,6 +1402,12 @@ type DecoyTimeout struct {
 	identifier       string
 	registrationTime time.Time
 	regID            string
+
+	// index of the timeout in decoysTimeouts and its position in the expiry queue
+	// for its transport
+	index      string
+	transport  pb.TransportType
+	queueIndex int
 }
 
 type RegisteredDecoys struct {
@@ -451,17 +1418,173 @@ type RegisteredDecoys struct {
 	// between transports.
 	decoys map[string]map[string]*DecoyRegistration
 
+	// altDecoys maps the fallback v4 phantoms of registrations that carry both a
+	// v6 and a v4 phantom to their registrations in the same way, so connections
+	// to either phantom match.
+	altDecoys map[string]map[string]*DecoyRegistration
+
 	transports map[pb.TransportType]Transport
 
 	decoysTimeouts map[string]*DecoyTimeout
-	m              sync.RWMutex
+
+	// registration timeouts ordered by registration time for each transport
+	expiryQueues map[pb.TransportType]*timeoutQueue
+
+	// map from registration fingerprint to registration used for deduplication
+	fingerprints map[[32]byte]*DecoyRegistration
+
+	// secret index used to detect active registrations whose shared secrets share
+	// an id prefix, which makes correlating them in logs ambiguous. Maps the first
+	// idPrefixLen hex characters of a secret to the count of tracked registrations
+	// for each full secret with that prefix.
+	idPrefixLen int
+	idPrefixes  map[string]map[string]int
+
+	// encoding and channel used when sharing registrations with the detector
+	detectorEncoding DetectorEncoding
+	publisher        DetectorPublisher
+
+	// coalesce expiry events from a single eviction tick into one message
+	batchExpiry bool
+
+	// registration timeouts for transports that do not use the default
+	transportTimeouts map[pb.TransportType]time.Duration
+
+	// maximum number of tracked registrations awaiting expiry, 0 for no limit
+	maxTracked int
+
+	// Prometheus collectors, nil unless RegisterMetrics is called
+	metrics *registrationMetrics
+
+	m sync.RWMutex
 }
 
 func NewRegisteredDecoys() *RegisteredDecoys {
 	return &RegisteredDecoys{
 		decoys:         make(map[string]map[string]*DecoyRegistration),
+		altDecoys:      make(map[string]map[string]*DecoyRegistration),
 		transports:     make(map[pb.TransportType]Transport),
 		decoysTimeouts: make(map[string]*DecoyTimeout),
+		expiryQueues:   make(map[pb.TransportType]*timeoutQueue),
+		fingerprints:   make(map[[32]byte]*DecoyRegistration),
+		idPrefixLen:    regIDLen,
+		idPrefixes:     make(map[string]map[string]int),
+		publisher:      redisPublisher{},
+
+		transportTimeouts: make(map[pb.TransportType]time.Duration),
+	}
+}
+
+// SetIDCollisionPrefixLen sets the number of hex characters of the shared secret
+// compared when warning about registration id collisions.
+func (r *RegisteredDecoys) SetIDCollisionPrefixLen(n int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.idPrefixLen = n
+	index := r.idPrefixes
+	r.idPrefixes = make(map[string]map[string]int)
+	for _, secrets := range index {
+		for secret, count := range secrets {
+			r.indexSecretHex(secret, count)
+		}
+	}
+}
+
+func (r *RegisteredDecoys) idPrefix(secret string) string {
+	if len(secret) < r.idPrefixLen {
+		return secret
+	}
+	return secret[:r.idPrefixLen]
+}
+
+// indexSecret adds a tracked registration to the secret index, warning if its id
+// prefix collides with a different active secret.
+func (r *RegisteredDecoys) indexSecret(d *DecoyRegistration) {
+	if d.Keys == nil {
+		return
+	}
+	r.indexSecretHex(hex.EncodeToString(d.Keys.SharedSecret), 1)
+}
+
+func (r *RegisteredDecoys) indexSecretHex(secret string, count int) {
+	prefix := r.idPrefix(secret)
+	secrets, ok := r.idPrefixes[prefix]
+	if !ok {
+		secrets = make(map[string]int)
+		r.idPrefixes[prefix] = secrets
+	}
+
+	_, known := secrets[secret]
+	secrets[secret] += count
+	if !known && len(secrets) > 1 {
+		Stat().AddIDCollision(prefix, len(secrets))
+	}
+}
+
+// secretTracked returns true if a registration with the shared secret is tracked.
+func (r *RegisteredDecoys) secretTracked(secret []byte) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	hexSecret := hex.EncodeToString(secret)
+	return r.idPrefixes[r.idPrefix(hexSecret)][hexSecret] > 0
+}
+
+func (r *RegisteredDecoys) unindexSecret(d *DecoyRegistration) {
+	if d.Keys == nil {
+		return
+	}
+
+	secret := hex.EncodeToString(d.Keys.SharedSecret)
+	prefix := r.idPrefix(secret)
+	secrets, ok := r.idPrefixes[prefix]
+	if !ok {
+		return
+	}
+
+	secrets[secret]--
+	if secrets[secret] <= 0 {
+		delete(secrets, secret)
+	}
+	if len(secrets) == 0 {
+		delete(r.idPrefixes, prefix)
+	}
+}
+
+// indexAlt tracks the fallback phantom of a registration, if it has one. Another
+// registration already using the address with the same identifier is not replaced.
+// Must be called with the lock held.
+func (r *RegisteredDecoys) indexAlt(d *DecoyRegistration, identifier string) {
+	if d.AltDarkDecoy == nil {
+		return
+	}
+
+	altAddr := d.AltDarkDecoy.String()
+	if _, exists := r.decoys[altAddr][identifier]; exists {
+		return
+	}
+	if _, exists := r.altDecoys[altAddr]; !exists {
+		r.altDecoys[altAddr] = map[string]*DecoyRegistration{}
+	}
+	if _, exists := r.altDecoys[altAddr][identifier]; !exists {
+		r.altDecoys[altAddr][identifier] = d
+	}
+}
+
+// unindexAlt stops tracking the fallback phantom of a registration. Must be called
+// with the lock held.
+func (r *RegisteredDecoys) unindexAlt(d *DecoyRegistration, identifier string) {
+	if d.AltDarkDecoy == nil {
+		return
+	}
+
+	altAddr := d.AltDarkDecoy.String()
+	if r.altDecoys[altAddr][identifier] == d {
+		delete(r.altDecoys[altAddr], identifier)
+		if len(r.altDecoys[altAddr]) == 0 {
+			delete(r.altDecoys, altAddr)
+		}
 	}
 }
 
@@ -475,11 +1598,22 @@ func (r *RegisteredDecoys) Track(d *DecoyRegistration) error {
 
 // For use inside of this struct (so no deadlocks on struct mutex)
 func (r *RegisteredDecoys) track(d *DecoyRegistration) error {
+	return r.trackAt(d, time.Now())
+}
+
+// trackAt tracks the registration with its timeout starting at registered. Must be
+// called with the lock held.
+func (r *RegisteredDecoys) trackAt(d *DecoyRegistration, registered time.Time) error {
 
 	// Is the registration is already tracked.
 	if reg := r.registrationExists(d); reg != nil {
-		// update tracked registration with new information if any
+		// update tracked registration with new information if any, this is the one
+		// place repeats of a registration are counted
 		reg.regCount++
+		Stat().AddDupReg()
+		r.metrics.deduplicateRegistration()
+		// a repeated registration restarts the timeout for the existing entry
+		r.refreshTimeout(reg.IDString() + reg.DarkDecoy.String())
 		return nil
 	}
 
@@ -488,6 +1622,13 @@ func (r *RegisteredDecoys) track(d *DecoyRegistration) error {
 		return fmt.Errorf("unknown transport %d", d.Transport)
 	}
 
+	if r.maxTracked > 0 && len(r.decoysTimeouts) >= r.maxTracked && !d.bypassLimits {
+		// Shed new registrations rather than growing without bound until the
+		// expiry loop catches up.
+		Stat().AddBackpressureReg()
+		return ErrRegistrationBackpressure
+	}
+
 	phantomAddr := d.DarkDecoy.String()
 	identifier := t.GetIdentifier(d)
 
@@ -501,14 +1642,19 @@ func (r *RegisteredDecoys) track(d *DecoyRegistration) error {
 	}
 
 	r.decoys[phantomAddr][identifier] = d
+	r.indexAlt(d, identifier)
+	r.fingerprints[d.Fingerprint()] = d
+	r.indexSecret(d)
 
-	newtimeout := &DecoyTimeout{
+	r.addTimeout(&DecoyTimeout{
 		decoy:            phantomAddr,
 		identifier:       identifier,
-		registrationTime: time.Now(),
+		registrationTime: registered,
 		regID:            d.IDString(),
-	}
-	r.decoysTimeouts[d.IDString()+phantomAddr] = newtimeout
+		index:            d.IDString() + phantomAddr,
+		transport:        d.Transport,
+	})
+	r.metrics.addRegistration()
 
 	return nil
 }
@@ -534,12 +1680,14 @@ func (r *RegisteredDecoys) register(darkDecoyAddr string, d *DecoyRegistration)
 	}
 
 	if reg.Valid {
-		// Registration has already been shared with the detector
-		return nil
+		// Registration has already been shared with the detector, so a repeat
+		// refreshes it rather than adding another entry. Tracking it again counts
+		// the repeat.
+		return r.track(d)
 	}
 
 	reg.Valid = true
-	registerForDetector(reg)
+	publishForDetector(r.publisher, EventRegister, reg, r.detectorEncoding)
 
 	return nil
 }
@@ -560,6 +1708,163 @@ func (r *RegisteredDecoys) getRegistrations(darkDecoyAddr net.IP) map[string]*De
 		}
 	}
 
+	// registrations using this address as their fallback phantom
+	for k, v := range r.altDecoys[darkDecoyAddrStatic] {
+		if _, exists := regs[k]; !exists && v.Valid {
+			regs[k] = v
+		}
+	}
+
+	return regs
+}
+
+func (r *RegisteredDecoys) updateCovert(secret []byte, newCovert string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	updated := 0
+	for _, regSet := range r.decoys {
+		for _, reg := range regSet {
+			if reg.Keys != nil && bytes.Equal(reg.Keys.SharedSecret, secret) {
+				reg.Covert = newCovert
+				updated++
+			}
+		}
+	}
+
+	if updated == 0 {
+		return fmt.Errorf("no registration found for secret")
+	}
+	return nil
+}
+
+// migrateGeneration moves the registrations of generation oldGen to the phantom
+// chosen for them by selectPhantom in generation newGen, returning the number of
+// registrations migrated and an error for each one that could not be. The
+// registrations to migrate are collected before any of them is moved so that the
+// registrations re-added under their new phantom are not visited again.
+func (r *RegisteredDecoys) migrateGeneration(oldGen, newGen uint32, selectPhantom func(*DecoyRegistration) (net.IP, *net.IPNet, net.IP, error)) (int, []error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	type migration struct {
+		index   string
+		timeout *DecoyTimeout
+		reg     *DecoyRegistration
+	}
+
+	var pending []migration
+	for index, timeout := range r.decoysTimeouts {
+		reg, ok := r.decoys[timeout.decoy][timeout.identifier]
+		if !ok || reg.DecoyListVersion != oldGen || reg.Keys == nil {
+			continue
+		}
+		pending = append(pending, migration{index, timeout, reg})
+	}
+
+	migrated := 0
+	var failures []error
+	for _, m := range pending {
+		reg, timeout := m.reg, m.timeout
+
+		t, ok := r.transports[reg.Transport]
+		if !ok {
+			failures = append(failures, fmt.Errorf("%s: unknown transport %s", reg.IDString(), reg.Transport))
+			continue
+		}
+
+		phantom, subnet, alt, err := selectPhantom(reg)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s: %v", reg.IDString(), err))
+			continue
+		}
+
+		moved := *reg
+		moved.DarkDecoy = phantom
+		phantomAddr := phantom.String()
+		identifier := t.GetIdentifier(&moved)
+		if existing, exists := r.decoys[phantomAddr][identifier]; exists && existing != reg {
+			failures = append(failures, fmt.Errorf("%s: phantom %s already tracks registration %s", reg.IDString(), phantomAddr, existing.IDString()))
+			continue
+		}
+
+		// Drop the registration from the old phantom.
+		if reg.Valid {
+			publishForDetector(r.publisher, EventExpire, reg, r.detectorEncoding)
+		}
+		Stat().ExpireReg(reg.DecoyListVersion, reg.RegistrationSource, reg.PhantomSubnet)
+		r.dropTimeout(m.index)
+		delete(r.decoys[timeout.decoy], timeout.identifier)
+		if len(r.decoys[timeout.decoy]) == 0 {
+			delete(r.decoys, timeout.decoy)
+		}
+		r.unindexAlt(reg, timeout.identifier)
+		if fp := reg.Fingerprint(); r.fingerprints[fp] == reg {
+			delete(r.fingerprints, fp)
+		}
+
+		reg.DarkDecoy = phantom
+		reg.AltDarkDecoy = alt
+		reg.PhantomSubnet = subnet.String()
+		reg.DecoyListVersion = newGen
+
+		// Re-add it under the new phantom, keeping its original age.
+		if _, exists := r.decoys[phantomAddr]; !exists {
+			r.decoys[phantomAddr] = map[string]*DecoyRegistration{}
+		}
+		r.decoys[phantomAddr][identifier] = reg
+		r.indexAlt(reg, identifier)
+		r.fingerprints[reg.Fingerprint()] = reg
+		r.addTimeout(&DecoyTimeout{
+			decoy:            phantomAddr,
+			identifier:       identifier,
+			registrationTime: timeout.registrationTime,
+			regID:            timeout.regID,
+			index:            reg.IDString() + phantomAddr,
+			transport:        reg.Transport,
+		})
+		Stat().AddReg(reg.DecoyListVersion, reg.RegistrationSource, reg.PhantomSubnet)
+		if reg.Valid {
+			publishForDetector(r.publisher, EventRegister, reg, r.detectorEncoding)
+		}
+
+		migrated++
+	}
+
+	return migrated, failures
+}
+
+func (r *RegisteredDecoys) findByCovert(covert string) []*DecoyRegistration {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	var regs []*DecoyRegistration
+	for _, regSet := range r.decoys {
+		for _, reg := range regSet {
+			if reg.Covert == covert {
+				regCopy := *reg
+				regs = append(regs, &regCopy)
+			}
+		}
+	}
+	return regs
+}
+
+// findByIDPrefix returns copies of all tracked registrations whose hex encoded shared
+// secret starts with prefix.
+func (r *RegisteredDecoys) findByIDPrefix(prefix string) []*DecoyRegistration {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	var regs []*DecoyRegistration
+	for _, regSet := range r.decoys {
+		for _, reg := range regSet {
+			if reg.Keys != nil && strings.HasPrefix(hex.EncodeToString(reg.Keys.SharedSecret), prefix) {
+				regCopy := *reg
+				regs = append(regs, &regCopy)
+			}
+		}
+	}
 	return regs
 }
 
@@ -570,6 +1875,22 @@ func (r *RegisteredDecoys) TotalRegistrations() int {
 	return r.totalRegistrations()
 }
 
+// Snapshot returns copies of all tracked registrations. The copies can be read and
+// serialized without holding the registration lock.
+func (r *RegisteredDecoys) Snapshot() []*DecoyRegistration {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	regs := make([]*DecoyRegistration, 0, r.totalRegistrations())
+	for _, regSet := range r.decoys {
+		for _, reg := range regSet {
+			regCopy := *reg
+			regs = append(regs, &regCopy)
+		}
+	}
+	return regs
+}
+
 func (r *RegisteredDecoys) totalRegistrations() int {
 
 	total := 0
@@ -579,16 +1900,45 @@ func (r *RegisteredDecoys) totalRegistrations() int {
 	return total
 }
 
-func (r *RegisteredDecoys) countRegistrations(darkDecoyAddr net.IP) int {
-	ddAddrStr := darkDecoyAddr.String()
+func (r *RegisteredDecoys) countByFamily() (v4, v6 int) {
 	r.m.RLock()
 	defer r.m.RUnlock()
 
-	regs, exists := r.decoys[ddAddrStr]
-	if !exists {
+	for phantom, regSet := range r.decoys {
+		if net.ParseIP(phantom).To4() != nil {
+			v4 += len(regSet)
+		} else {
+			v6 += len(regSet)
+		}
+	}
+	return v4, v6
+}
+
+// phantomCollisions returns the number of other secrets with registrations tracked
+// for the phantom of d.
+func (r *RegisteredDecoys) phantomCollisions(d *DecoyRegistration) int {
+	if d.Keys == nil {
 		return 0
 	}
-	return len(regs)
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	secrets := map[string]bool{}
+	for _, reg := range r.decoys[d.DarkDecoy.String()] {
+		if reg.Keys != nil && !bytes.Equal(reg.Keys.SharedSecret, d.Keys.SharedSecret) {
+			secrets[string(reg.Keys.SharedSecret)] = true
+		}
+	}
+	return len(secrets)
+}
+
+func (r *RegisteredDecoys) countRegistrations(darkDecoyAddr net.IP) int {
+	ddAddrStr := darkDecoyAddr.String()
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return len(r.decoys[ddAddrStr]) + len(r.altDecoys[ddAddrStr])
 }
 
 // RegistrationExists - For use outside of this struct only (so there are no data races.)
@@ -603,6 +1953,12 @@ func (r *RegisteredDecoys) RegistrationExists(d *DecoyRegistration) *DecoyRegist
 // For use inside of this struct (so no deadlocks on struct mutex)
 func (r *RegisteredDecoys) registrationExists(d *DecoyRegistration) *DecoyRegistration {
 
+	// Registrations for the same secret, phantom and generation are the same
+	// registration no matter when or how often they are received.
+	if reg, ok := r.fingerprints[d.Fingerprint()]; ok {
+		return reg
+	}
+
 	t, ok := r.transports[d.Transport]
 	if !ok {
 		return nil
@@ -632,33 +1988,51 @@ type regExpireLogMsg struct {
 	RegCount   int32
 }
 
-func (r *RegisteredDecoys) getExpiredRegistrations() []string {
-	r.m.RLock()
-	defer r.m.RUnlock()
-
-	const regTimeout = time.Hour * 6
-	var cutoff = time.Now().Add(-regTimeout)
-	var expiredRegTimeoutIndices = []string{}
+// regTimeout is how long a registration is tracked after it was first received
+// unless another timeout is configured.
+const regTimeout = time.Hour * 6
 
-	for idx, decoyTimeout := range r.decoysTimeouts {
-		if decoyTimeout.registrationTime.Before(cutoff) {
-			// if a registration was received before the cutoff time add it
-			// to the list of registrations to be removed.
-			expiredRegTimeoutIndices = append(expiredRegTimeoutIndices, idx)
-		}
+// timeoutFor returns how long registrations using transport are tracked, using
+// defaultTimeout (or regTimeout if it is zero) unless a timeout is configured for
+// the transport. Must be called with the lock held.
+func (r *RegisteredDecoys) timeoutFor(transport pb.TransportType, defaultTimeout time.Duration) time.Duration {
+	if timeout, ok := r.transportTimeouts[transport]; ok {
+		return timeout
 	}
+	if defaultTimeout > 0 {
+		return defaultTimeout
+	}
+	return regTimeout
+}
+
+// expiresAt returns when the registration tracked by timeout expires. Must be called
+// with the lock held.
+func (r *RegisteredDecoys) expiresAt(timeout *DecoyTimeout, defaultTimeout time.Duration) time.Time {
+	return timeout.registrationTime.Add(r.timeoutFor(timeout.transport, defaultTimeout))
+}
+
+func (r *RegisteredDecoys) getExpiredRegistrations(defaultTimeout time.Duration) []string {
+	r.m.RLock()
+	defer r.m.RUnlock()
 
-	return expiredRegTimeoutIndices
+	return r.expiredTimeouts(time.Now(), defaultTimeout)
 }
 
-func (r *RegisteredDecoys) removeRegistration(index string) *regExpireLogMsg {
+// removeRegistration drops the registration with the given timeout index, returning
+// it with a summary for logging. If pending is non-nil the expiry event for a valid
+// registration is appended to it for the caller to publish rather than being
+// published immediately.
+func (r *RegisteredDecoys) removeRegistration(index string, pending *[]*DecoyRegistration) (*regExpireLogMsg, *DecoyRegistration) {
 	r.m.Lock()
 	defer r.m.Unlock()
 
-	expiredReg := r.decoysTimeouts[index]
+	expiredReg, ok := r.decoysTimeouts[index]
+	if !ok {
+		return nil, nil
+	}
 	expiredRegObj, ok := r.decoys[expiredReg.decoy][expiredReg.identifier]
 	if !ok {
-		return nil
+		return nil, nil
 	}
 
 	stats := &regExpireLogMsg{
@@ -668,68 +2042,212 @@ func (r *RegisteredDecoys) removeRegistration(index string) *regExpireLogMsg {
 		RegCount:   expiredRegObj.regCount,
 	}
 
-	// Update stats
-	Stat().ExpireReg(expiredRegObj.DecoyListVersion, expiredRegObj.RegistrationSource)
+	// Update stats, the self-test registration is never counted
+	if !expiredRegObj.selfTest {
+		Stat().ExpireReg(expiredRegObj.DecoyListVersion, expiredRegObj.RegistrationSource, expiredRegObj.PhantomSubnet)
+	}
 
 	// remove from timeout tracking
-	delete(r.decoysTimeouts, index)
+	r.dropTimeout(index)
 
 	// remove from decoy tracking
 	delete(r.decoys[expiredReg.decoy], expiredReg.identifier)
+	r.unindexAlt(expiredRegObj, expiredReg.identifier)
+	r.unindexSecret(expiredRegObj)
+	if fp := expiredRegObj.Fingerprint(); r.fingerprints[fp] == expiredRegObj {
+		delete(r.fingerprints, fp)
+	}
+
+	if expiredRegObj.Valid {
+		if pending != nil {
+			*pending = append(*pending, expiredRegObj)
+		} else {
+			publishForDetector(r.publisher, EventExpire, expiredRegObj, r.detectorEncoding)
+		}
+	}
 
 	// if no more registration exist for this phantom clean up
 	if len(r.decoys[expiredReg.decoy]) == 0 {
 		delete(r.decoys, expiredReg.decoy)
 	}
 
-	return stats
+	return stats, expiredRegObj
 }
 
 // This whole process of tracking timeouts and registrations separately
 // makes less and less sense every time I come back to it.
 // Note: please try to limit duration that this process is capable of taking the
 // lock on the RegisteredDecoys mutex to prevent thread locking.
-func (r *RegisteredDecoys) removeOldRegistrations(logger *log.Logger) {
-	var expiredRegTimeoutIndices = r.getExpiredRegistrations()
+// removeOldRegistrations expires registrations that have timed out and returns them.
+// Registrations time out after defaultTimeout unless a timeout is configured for their
+// transport; zero selects the default of 6 hours.
+func (r *RegisteredDecoys) removeOldRegistrations(logger *log.Logger, defaultTimeout time.Duration) []*DecoyRegistration {
+	start := time.Now()
+	var expiredRegTimeoutIndices = r.getExpiredRegistrations(defaultTimeout)
 
 	logger.Printf("cleansing registrations - registrations: %d, timeouts: %d, expired: %d",
 		r.TotalRegistrations(), len(r.decoysTimeouts), len(expiredRegTimeoutIndices))
 
+	r.m.RLock()
+	batcher, canBatch := r.publisher.(BatchDetectorPublisher)
+	batch := r.batchExpiry && canBatch
+	encoding := r.detectorEncoding
+	metrics := r.metrics
+	r.m.RUnlock()
+
+	var unpublished []*DecoyRegistration
+	var pending *[]*DecoyRegistration
+	if batch {
+		pending = &unpublished
+	}
+
+	var removed []*DecoyRegistration
 	for _, idx := range expiredRegTimeoutIndices {
 
-		stats := r.removeRegistration(idx)
+		stats, reg := r.removeRegistration(idx, pending)
 		if stats != nil {
+			removed = append(removed, reg)
 			statsStr, _ := json.Marshal(stats)
 			logger.Printf("expired registration %s", statsStr)
 		}
 	}
+
+	if len(unpublished) > 0 {
+		publishBatchForDetector(batcher, EventExpire, unpublished, encoding)
+	}
+
+	duration := time.Since(start)
+	Stat().ExpiryTick(len(removed), duration)
+	metrics.expiryTick(len(removed), duration)
+	return removed
 }
 
-// **NOTE**: If you mess with this function make sure the
-// session tracking tests on the detector side do what you expect
-// them to do. (conjure/src/session.rs)
-func registerForDetector(reg *DecoyRegistration) {
-	client := getRedisClient()
-	if client == nil {
-		fmt.Printf("couldn't connect to redis")
-		return
+// DetectorEncoding selects how registrations are encoded when they are shared with
+// the detector.
+type DetectorEncoding int
+
+const (
+	// DetectorEncodingBinary is the legacy protobuf encoded StationToDetector message
+	// understood by the current detector. This is the default.
+	DetectorEncodingBinary DetectorEncoding = iota
+
+	// DetectorEncodingJSON encodes registrations as a JSON object for detectors
+	// where parsing protobuf address bytes is awkward.
+	DetectorEncodingJSON
+)
+
+// ParseDetectorEncoding parses the station config name of a DetectorEncoding. An
+// empty string selects the default encoding.
+func ParseDetectorEncoding(name string) (DetectorEncoding, error) {
+	switch name {
+	case "", "binary":
+		return DetectorEncodingBinary, nil
+	case "json":
+		return DetectorEncodingJSON, nil
+	default:
+		return DetectorEncodingBinary, fmt.Errorf("unknown detector encoding \"%s\"", name)
 	}
+}
 
+type detectorJSONPayload struct {
+	Phantom     string `json:"phantom"`
+	PhantomPort uint32 `json:"phantom_port"`
+	Client      string `json:"client"`
+	TimeoutNs   uint64 `json:"timeout_ns"`
+	Generation  uint32 `json:"generation"`
+	Transport   string `json:"transport"`
+}
+
+// DetectorPayload returns the message shared with the detector for this registration
+// in the requested encoding.
+func (reg *DecoyRegistration) DetectorPayload(encoding DetectorEncoding) ([]byte, error) {
+	return reg.detectorPayload(reg.DarkDecoy, encoding)
+}
+
+// DetectorPayloads returns the messages shared with the detector for this
+// registration in the requested encoding, one for each of its phantoms.
+func (reg *DecoyRegistration) DetectorPayloads(encoding DetectorEncoding) ([][]byte, error) {
+	var payloads [][]byte
+	for _, phantom := range reg.phantoms() {
+		payload, err := reg.detectorPayload(phantom, encoding)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+func (reg *DecoyRegistration) detectorPayload(phantomAddr net.IP, encoding DetectorEncoding) ([]byte, error) {
 	duration := uint64(6 * time.Hour.Nanoseconds())
 	src := reg.registrationAddr.String()
-	phantom := reg.DarkDecoy.String()
-	phantomPort := reg.PhantomPort
-	msg := &pb.StationToDetector{
-		PhantomIp:   &phantom,
-		PhantomPort: phantomPort,
-		ClientIp:    &src,
-		TimeoutNs:   &duration,
+	phantom := phantomAddr.String()
+
+	switch encoding {
+	case DetectorEncodingBinary:
+		msg := &pb.StationToDetector{
+			PhantomIp:   &phantom,
+			PhantomPort: reg.PhantomPort,
+			ClientIp:    &src,
+			TimeoutNs:   &duration,
+		}
+		return proto.Marshal(msg)
+	case DetectorEncodingJSON:
+		return json.Marshal(detectorJSONPayload{
+			Phantom:     phantom,
+			PhantomPort: reg.PhantomPort,
+			Client:      src,
+			TimeoutNs:   duration,
+			Generation:  reg.DecoyListVersion,
+			Transport:   reg.Transport.String(),
+		})
+	default:
+		return nil, fmt.Errorf("unknown detector encoding %d", encoding)
+	}
+}
+
+// **NOTE**: If you mess with this function make sure the
+// session tracking tests on the detector side do what you expect
+// them to do. (conjure/src/session.rs)
+func publishForDetector(publisher DetectorPublisher, event RegistrationEvent, reg *DecoyRegistration, encoding DetectorEncoding) {
+	if reg.selfTest {
+		return
 	}
 
-	s2d, err := proto.Marshal(msg)
+	payloads, err := reg.DetectorPayloads(encoding)
 	if err != nil {
 		// throw(fit)
 		return
 	}
-	client.Publish(DETECTOR_REG_CHANNEL, string(s2d))
+
+	for _, s2d := range payloads {
+		err = publisher.Publish(event, encoding, s2d)
+		Stat().DetectorPublish(err)
+		if err != nil {
+			fmt.Printf("failed to publish %s event for detector: %v\n", event, err)
+		}
+	}
+}
+
+func publishBatchForDetector(publisher BatchDetectorPublisher, event RegistrationEvent, regs []*DecoyRegistration, encoding DetectorEncoding) {
+	payloads := make([][]byte, 0, len(regs))
+	for _, reg := range regs {
+		if reg.selfTest {
+			continue
+		}
+		s2d, err := reg.DetectorPayloads(encoding)
+		if err != nil {
+			continue
+		}
+		payloads = append(payloads, s2d...)
+	}
+	if len(payloads) == 0 {
+		return
+	}
+
+	err := publisher.PublishBatch(event, encoding, payloads)
+	Stat().DetectorPublish(err)
+	if err != nil {
+		fmt.Printf("failed to publish %s batch of %d for detector: %v\n", event, len(payloads), err)
+	}
 }
@@ -0,0 +1,353 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// RegistrationCodec serializes registrations for storage outside of the station
+// process (snapshots, exports, write ahead logs).
+//
+// Only the shared secret is encoded from the registration keys. Every other key is
+// derived from the secret so it is regenerated on decode rather than written out,
+// keeping the amount of key material at rest to a minimum. Encoded registrations
+// still contain the shared secret and must be protected accordingly.
+type RegistrationCodec interface {
+	// Name returns the station config name of the codec.
+	Name() string
+
+	Encode(reg *DecoyRegistration) ([]byte, error)
+	Decode(data []byte) (*DecoyRegistration, error)
+}
+
+// ParseRegistrationCodec returns the codec with the given station config name. An
+// empty string selects the gob codec.
+func ParseRegistrationCodec(name string) (RegistrationCodec, error) {
+	switch name {
+	case "", "gob":
+		return GobRegistrationCodec{}, nil
+	case "json":
+		return JSONRegistrationCodec{}, nil
+	case "protobuf":
+		return ProtobufRegistrationCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown registration codec \"%s\"", name)
+	}
+}
+
+// ErrRegistrationDecrypt is returned when an encrypted registration can not be
+// authenticated, most likely because it was encrypted with a different key.
+var ErrRegistrationDecrypt = errors.New("failed to decrypt registration, wrong key or corrupt data")
+
+// encryptedRegistrationCodec encrypts the output of another codec with AES-GCM so
+// that shared secrets are never written to disk in plaintext.
+type encryptedRegistrationCodec struct {
+	RegistrationCodec
+	aead cipher.AEAD
+}
+
+// NewEncryptedRegistrationCodec wraps codec so that encoded registrations are sealed
+// with AES-GCM under key, which must be 16, 24 or 32 bytes long. Each registration is
+// encrypted with a fresh random nonce that is prepended to the ciphertext. Decoding
+// data sealed under a different key fails with ErrRegistrationDecrypt.
+func NewEncryptedRegistrationCodec(codec RegistrationCodec, key []byte) (RegistrationCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registration encryption key: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedRegistrationCodec{RegistrationCodec: codec, aead: aead}, nil
+}
+
+func (c *encryptedRegistrationCodec) Encode(reg *DecoyRegistration) ([]byte, error) {
+	plaintext, err := c.RegistrationCodec.Encode(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c *encryptedRegistrationCodec) Decode(data []byte) (*DecoyRegistration, error) {
+	if len(data) < c.aead.NonceSize() {
+		return nil, ErrRegistrationDecrypt
+	}
+
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrRegistrationDecrypt
+	}
+	return c.RegistrationCodec.Decode(plaintext)
+}
+
+// persistedRegistration is the codec independent form of a DecoyRegistration.
+type persistedRegistration struct {
+	SharedSecret       []byte    `json:"shared_secret"`
+	Phantom            net.IP    `json:"phantom"`
+	AltPhantom         net.IP    `json:"alt_phantom,omitempty"`
+	PhantomSubnet      string    `json:"phantom_subnet,omitempty"`
+	PhantomPort        uint32    `json:"phantom_port"`
+	DecoyAddr          net.IP    `json:"decoy_addr,omitempty"`
+	RegistrationAddr   net.IP    `json:"registration_addr,omitempty"`
+	Covert             string    `json:"covert"`
+	Mask               string    `json:"mask,omitempty"`
+	Flags              []byte    `json:"flags,omitempty"` // protobuf encoded RegistrationFlags
+	Transport          int32     `json:"transport"`
+	RegistrationTime   time.Time `json:"registration_time"`
+	RegistrationSource *int32    `json:"registration_source,omitempty"`
+	DecoyListVersion   uint32    `json:"generation"`
+	RegCount           int32     `json:"reg_count"`
+	BypassLimits       bool      `json:"bypass_limits,omitempty"`
+	Valid              bool      `json:"valid"`
+}
+
+func newPersistedRegistration(reg *DecoyRegistration) (*persistedRegistration, error) {
+	if reg == nil {
+		return nil, errors.New("cannot encode nil registration")
+	}
+	if reg.Keys == nil || len(reg.Keys.SharedSecret) == 0 {
+		return nil, errors.New("cannot encode registration without a shared secret")
+	}
+
+	p := &persistedRegistration{
+		SharedSecret:     reg.Keys.SharedSecret,
+		Phantom:          reg.DarkDecoy,
+		AltPhantom:       reg.AltDarkDecoy,
+		PhantomSubnet:    reg.PhantomSubnet,
+		PhantomPort:      reg.PhantomPort,
+		DecoyAddr:        reg.DecoyAddr,
+		RegistrationAddr: reg.registrationAddr,
+		Covert:           reg.Covert,
+		Mask:             reg.Mask,
+		Transport:        int32(reg.Transport),
+		RegistrationTime: reg.RegistrationTime,
+		DecoyListVersion: reg.DecoyListVersion,
+		RegCount:         reg.regCount,
+		BypassLimits:     reg.bypassLimits,
+		Valid:            reg.Valid,
+	}
+
+	if reg.Flags != nil {
+		flags, err := proto.Marshal(reg.Flags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode registration flags: %v", err)
+		}
+		p.Flags = flags
+	}
+
+	if reg.RegistrationSource != nil {
+		source := int32(*reg.RegistrationSource)
+		p.RegistrationSource = &source
+	}
+
+	return p, nil
+}
+
+func (p *persistedRegistration) registration() (*DecoyRegistration, error) {
+	if len(p.SharedSecret) == 0 {
+		return nil, errors.New("encoded registration has no shared secret")
+	}
+
+	keys, err := GenSharedKeys(p.SharedSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive registration keys: %v", err)
+	}
+
+	reg := &DecoyRegistration{
+		DarkDecoy:        p.Phantom,
+		AltDarkDecoy:     p.AltPhantom,
+		PhantomSubnet:    p.PhantomSubnet,
+		PhantomPort:      p.PhantomPort,
+		DecoyAddr:        p.DecoyAddr,
+		registrationAddr: p.RegistrationAddr,
+		Keys:             &keys,
+		Covert:           p.Covert,
+		Mask:             p.Mask,
+		Transport:        pb.TransportType(p.Transport),
+		RegistrationTime: p.RegistrationTime,
+		DecoyListVersion: p.DecoyListVersion,
+		regCount:         p.RegCount,
+		bypassLimits:     p.BypassLimits,
+		Valid:            p.Valid,
+	}
+
+	if p.Flags != nil {
+		reg.Flags = &pb.RegistrationFlags{}
+		if err := proto.Unmarshal(p.Flags, reg.Flags); err != nil {
+			return nil, fmt.Errorf("failed to decode registration flags: %v", err)
+		}
+	}
+
+	if p.RegistrationSource != nil {
+		source := pb.RegistrationSource(*p.RegistrationSource)
+		reg.RegistrationSource = &source
+	}
+
+	return reg, nil
+}
+
+// GobRegistrationCodec encodes registrations with encoding/gob.
+type GobRegistrationCodec struct{}
+
+func (GobRegistrationCodec) Name() string { return "gob" }
+
+func (GobRegistrationCodec) Encode(reg *DecoyRegistration) ([]byte, error) {
+	p, err := newPersistedRegistration(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobRegistrationCodec) Decode(data []byte) (*DecoyRegistration, error) {
+	p := &persistedRegistration{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(p); err != nil {
+		return nil, err
+	}
+	return p.registration()
+}
+
+// JSONRegistrationCodec encodes registrations as JSON objects.
+type JSONRegistrationCodec struct{}
+
+func (JSONRegistrationCodec) Name() string { return "json" }
+
+func (JSONRegistrationCodec) Encode(reg *DecoyRegistration) ([]byte, error) {
+	p, err := newPersistedRegistration(reg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(p)
+}
+
+func (JSONRegistrationCodec) Decode(data []byte) (*DecoyRegistration, error) {
+	p := &persistedRegistration{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p.registration()
+}
+
+// ProtobufRegistrationCodec encodes registrations as PersistedRegistration
+// messages. The client facing fields are carried in a C2SWrapper, the same message
+// registrations are shared between stations with, and the station only state is
+// added around it.
+type ProtobufRegistrationCodec struct{}
+
+func (ProtobufRegistrationCodec) Name() string { return "protobuf" }
+
+func (ProtobufRegistrationCodec) Encode(reg *DecoyRegistration) ([]byte, error) {
+	p, err := newPersistedRegistration(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	generation := p.DecoyListVersion
+	transport := pb.TransportType(p.Transport)
+	c2s := &pb.ClientToStation{
+		DecoyListGeneration: &generation,
+		Transport:           &transport,
+		CovertAddress:       &p.Covert,
+		PhantomPort:         &p.PhantomPort,
+		Flags:               reg.Flags,
+	}
+	if p.Mask != "" {
+		c2s.MaskedDecoyServerName = &p.Mask
+	}
+
+	msg := &pb.PersistedRegistration{
+		Wrapper: &pb.C2SWrapper{
+			SharedSecret:        p.SharedSecret,
+			RegistrationPayload: c2s,
+			RegistrationSource:  reg.RegistrationSource,
+			RegistrationAddress: p.RegistrationAddr,
+			DecoyAddress:        p.DecoyAddr,
+		},
+		Phantom:      p.Phantom,
+		AltPhantom:   p.AltPhantom,
+		RegCount:     proto.Int32(p.RegCount),
+		BypassLimits: proto.Bool(p.BypassLimits),
+		Valid:        proto.Bool(p.Valid),
+	}
+	if p.PhantomSubnet != "" {
+		msg.PhantomSubnet = proto.String(p.PhantomSubnet)
+	}
+	if !p.RegistrationTime.IsZero() {
+		msg.RegistrationTimeNs = proto.Int64(p.RegistrationTime.UnixNano())
+	}
+	return proto.Marshal(msg)
+}
+
+func (ProtobufRegistrationCodec) Decode(data []byte) (*DecoyRegistration, error) {
+	msg := &pb.PersistedRegistration{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+
+	wrapper := msg.GetWrapper()
+	c2s := wrapper.GetRegistrationPayload()
+	p := &persistedRegistration{
+		SharedSecret:     wrapper.GetSharedSecret(),
+		PhantomSubnet:    msg.GetPhantomSubnet(),
+		PhantomPort:      c2s.GetPhantomPort(),
+		Covert:           c2s.GetCovertAddress(),
+		Mask:             c2s.GetMaskedDecoyServerName(),
+		Transport:        int32(c2s.GetTransport()),
+		DecoyListVersion: c2s.GetDecoyListGeneration(),
+		RegCount:         msg.GetRegCount(),
+		BypassLimits:     msg.GetBypassLimits(),
+		Valid:            msg.GetValid(),
+	}
+	if len(msg.GetPhantom()) > 0 {
+		p.Phantom = net.IP(msg.GetPhantom())
+	}
+	if len(msg.GetAltPhantom()) > 0 {
+		p.AltPhantom = net.IP(msg.GetAltPhantom())
+	}
+	if msg.RegistrationTimeNs != nil {
+		p.RegistrationTime = time.Unix(0, msg.GetRegistrationTimeNs())
+	}
+	if len(wrapper.GetRegistrationAddress()) > 0 {
+		p.RegistrationAddr = net.IP(wrapper.GetRegistrationAddress())
+	}
+	if len(wrapper.GetDecoyAddress()) > 0 {
+		p.DecoyAddr = net.IP(wrapper.GetDecoyAddress())
+	}
+	if wrapper.RegistrationSource != nil {
+		source := int32(wrapper.GetRegistrationSource())
+		p.RegistrationSource = &source
+	}
+
+	reg, err := p.registration()
+	if err != nil {
+		return nil, err
+	}
+	reg.Flags = c2s.GetFlags()
+	return reg, nil
+}
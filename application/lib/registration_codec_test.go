@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func fullCodecRegistration(t *testing.T) *DecoyRegistration {
+	keys, err := GenSharedKeys([]byte("registration codec round trip secret"))
+	require.Nil(t, err)
+
+	source := pb.RegistrationSource_API
+	return &DecoyRegistration{
+		DarkDecoy:          net.ParseIP("2001:db8::1:2"),
+		AltDarkDecoy:       net.ParseIP("192.0.2.7"),
+		PhantomSubnet:      "2001:db8::/64",
+		DecoyAddr:          net.ParseIP("198.51.100.7"),
+		PhantomPort:        8443,
+		registrationAddr:   net.ParseIP("203.0.113.9"),
+		Keys:               &keys,
+		Covert:             "192.0.2.99:443",
+		Mask:               "example.com",
+		Flags:              &pb.RegistrationFlags{Prescanned: proto.Bool(true), Use_TIL: proto.Bool(true)},
+		Transport:          pb.TransportType_Min,
+		RegistrationTime:   time.Now().Add(-time.Minute),
+		RegistrationSource: &source,
+		DecoyListVersion:   957,
+		regCount:           3,
+		bypassLimits:       true,
+		Valid:              true,
+	}
+}
+
+func requireSameRegistration(t *testing.T, expected, actual *DecoyRegistration) {
+	require.True(t, expected.DarkDecoy.Equal(actual.DarkDecoy))
+	require.True(t, expected.AltDarkDecoy.Equal(actual.AltDarkDecoy))
+	require.Equal(t, expected.PhantomSubnet, actual.PhantomSubnet)
+	require.True(t, expected.DecoyAddr.Equal(actual.DecoyAddr))
+	require.Equal(t, expected.PhantomPort, actual.PhantomPort)
+	require.True(t, expected.registrationAddr.Equal(actual.registrationAddr))
+	require.Equal(t, expected.Covert, actual.Covert)
+	require.Equal(t, expected.Mask, actual.Mask)
+	require.True(t, proto.Equal(expected.Flags, actual.Flags))
+	require.Equal(t, expected.Transport, actual.Transport)
+	require.True(t, expected.RegistrationTime.Equal(actual.RegistrationTime))
+	require.Equal(t, expected.RegistrationSource.String(), actual.RegistrationSource.String())
+	require.Equal(t, expected.DecoyListVersion, actual.DecoyListVersion)
+	require.Equal(t, expected.regCount, actual.regCount)
+	require.Equal(t, expected.bypassLimits, actual.bypassLimits)
+	require.Equal(t, expected.Valid, actual.Valid)
+
+	// Derived keys are regenerated from the shared secret.
+	require.Equal(t, expected.Keys.SharedSecret, actual.Keys.SharedSecret)
+	require.Equal(t, expected.Keys.DarkDecoySeed, actual.Keys.DarkDecoySeed)
+	require.Equal(t, expected.Keys.MasterSecret, actual.Keys.MasterSecret)
+	require.Equal(t, expected.Fingerprint(), actual.Fingerprint())
+}
+
+func TestRegistrationCodecRoundTrip(t *testing.T) {
+	for _, name := range []string{"gob", "json", "protobuf"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := ParseRegistrationCodec(name)
+			require.Nil(t, err)
+			require.Equal(t, name, codec.Name())
+
+			reg := fullCodecRegistration(t)
+			data, err := codec.Encode(reg)
+			require.Nil(t, err)
+
+			decoded, err := codec.Decode(data)
+			require.Nil(t, err)
+			requireSameRegistration(t, reg, decoded)
+
+			// Optional fields left unset stay unset.
+			minimal := &DecoyRegistration{
+				DarkDecoy: net.ParseIP("192.0.2.1"),
+				Keys:      &ConjureSharedKeys{SharedSecret: []byte("minimal codec secret")},
+				Covert:    "192.0.2.99:443",
+			}
+			data, err = codec.Encode(minimal)
+			require.Nil(t, err)
+
+			decoded, err = codec.Decode(data)
+			require.Nil(t, err)
+			require.Nil(t, decoded.Flags)
+			require.Nil(t, decoded.RegistrationSource)
+			require.Nil(t, decoded.DecoyAddr)
+			require.Equal(t, "", decoded.Mask)
+			require.False(t, decoded.Valid)
+			require.True(t, minimal.DarkDecoy.Equal(decoded.DarkDecoy))
+
+			// Registrations without a secret can not be restored.
+			_, err = codec.Encode(&DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1")})
+			require.NotNil(t, err)
+		})
+	}
+
+	// Protobuf encoded registrations are PersistedRegistration messages.
+	reg := fullCodecRegistration(t)
+	data, err := ProtobufRegistrationCodec{}.Encode(reg)
+	require.Nil(t, err)
+	msg := &pb.PersistedRegistration{}
+	require.Nil(t, proto.Unmarshal(data, msg))
+	require.Equal(t, reg.Keys.SharedSecret, msg.GetWrapper().GetSharedSecret())
+	require.Equal(t, reg.PhantomSubnet, msg.GetPhantomSubnet())
+	require.Equal(t, reg.RegistrationTime.UnixNano(), msg.GetRegistrationTimeNs())
+
+	_, err = ParseRegistrationCodec("xml")
+	require.NotNil(t, err)
+}
+
+func TestRegistrationCodecEncrypted(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	wrongKey := bytes.Repeat([]byte{0x24}, 32)
+
+	for _, name := range []string{"gob", "json", "protobuf"} {
+		t.Run(name, func(t *testing.T) {
+			inner, err := ParseRegistrationCodec(name)
+			require.Nil(t, err)
+
+			codec, err := NewEncryptedRegistrationCodec(inner, key)
+			require.Nil(t, err)
+			require.Equal(t, name, codec.Name())
+
+			reg := fullCodecRegistration(t)
+			data, err := codec.Encode(reg)
+			require.Nil(t, err)
+
+			// The shared secret is not stored in plaintext.
+			require.False(t, bytes.Contains(data, reg.Keys.SharedSecret))
+			require.False(t, bytes.Contains(data, []byte(reg.Covert)))
+
+			decoded, err := codec.Decode(data)
+			require.Nil(t, err)
+			requireSameRegistration(t, reg, decoded)
+
+			// Each encoding uses a fresh nonce.
+			again, err := codec.Encode(reg)
+			require.Nil(t, err)
+			require.NotEqual(t, data, again)
+
+			// Decoding with the wrong key, tampered data, or as plaintext fails.
+			wrong, err := NewEncryptedRegistrationCodec(inner, wrongKey)
+			require.Nil(t, err)
+			_, err = wrong.Decode(data)
+			require.Equal(t, ErrRegistrationDecrypt, err)
+
+			tampered := append([]byte(nil), data...)
+			tampered[len(tampered)-1] ^= 0x01
+			_, err = codec.Decode(tampered)
+			require.Equal(t, ErrRegistrationDecrypt, err)
+
+			_, err = codec.Decode(data[:4])
+			require.Equal(t, ErrRegistrationDecrypt, err)
+
+			plain, err := inner.Encode(reg)
+			require.Nil(t, err)
+			_, err = codec.Decode(plain)
+			require.NotNil(t, err)
+		})
+	}
+
+	_, err := NewEncryptedRegistrationCodec(GobRegistrationCodec{}, []byte("short"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// ErrBlocklistedCovert is returned by IngestRegistration when the registration has no
+// covert address or its covert address is blocklisted.
+var ErrBlocklistedCovert = errors.New("malformed or blocklisted covert")
+
+// ErrBlocklistedPhantom is returned by IngestRegistration when the phantom selected
+// for the registration is blocklisted on this station.
+var ErrBlocklistedPhantom = errors.New("blocklisted phantom")
+
+// IngestRegistration applies the checks every registration received by the station
+// goes through and adds it if they pass. A registration that is already tracked as
+// valid only refreshes the tracked entry. New registrations not marked as prescanned
+// are liveness tested, bounded by ctx, unless DeferDetectorPublish is set in which
+// case AddRegistration tests them. conf may be nil in which case no blocklists are
+// applied and registrations are not shared over the API.
+func (regManager *RegistrationManager) IngestRegistration(ctx context.Context, reg *DecoyRegistration, conf *Config) error {
+	logger := regManager.Logger
+
+	if !regManager.registrationIsNew(reg) {
+		// log phantom IP, shared secret, ipv6 support
+		logger.Printf("Duplicate registration: %v %s\n", reg.IDString(), reg.RegistrationSource)
+
+		// AddRegistration refreshes the tracked registration and counts the duplicate.
+		return regManager.AddRegistration(reg)
+	}
+
+	// log phantom IP, shared secret, ipv6 support
+	logger.Printf("New registration: %s %v\n", reg.IDString(), reg.String())
+
+	// Track the received registration, if it is already tracked it will just update the record
+	err := regManager.TrackRegistration(reg)
+	if err != nil {
+		Stat().AddErrReg()
+		return fmt.Errorf("error tracking registration: %w", err)
+	}
+
+	// Drop registrations with a malformed or blocklisted covert address
+	if reg.Covert == "" || (conf != nil && conf.IsBlocklisted(reg.Covert)) {
+		Stat().AddErrReg()
+		return fmt.Errorf("%w: %s", ErrBlocklistedCovert, reg.Covert)
+	}
+
+	if !reg.PreScanned() && !regManager.DeferDetectorPublish {
+		// New registration received over channel that requires liveness scan for the phantom
+		live, response := regManager.PhantomIsLiveContext(ctx, reg)
+		if live {
+			Stat().AddLivenessFail()
+			return fmt.Errorf("%w: %v", ErrPhantomInUse, response)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		Stat().AddLivenessPass()
+	}
+
+	if conf != nil && conf.EnableShareOverAPI && reg.RegistrationSource != nil && *reg.RegistrationSource == pb.RegistrationSource_Detector {
+		// Registration received from decoy-registrar, share over API if enabled.
+		go regManager.tryShareRegistrationOverAPI(reg, conf.PreshareEndpoint)
+	}
+
+	if conf != nil && conf.IsBlocklistedPhantom(reg.DarkDecoy) {
+		// Note: Phantom blocklist is applied at this stage because the phantom may only be blocked on this
+		// station. We may want other stations to be informed about the registration, but prevent this station
+		// specifically from handling / interfering in any subsequent connection. See PR #75
+		return fmt.Errorf("%w: %v", ErrBlocklistedPhantom, reg.DarkDecoy)
+	}
+
+	// validate the registration
+	err = regManager.AddRegistration(reg)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Adding registration %v\n", reg.IDString())
+	Stat().AddReg(reg.DecoyListVersion, reg.RegistrationSource, reg.PhantomSubnet)
+	return nil
+}
+
+func (regManager *RegistrationManager) tryShareRegistrationOverAPI(reg *DecoyRegistration, apiEndpoint string) {
+	c2a := reg.GenerateC2SWrapper()
+
+	payload, err := proto.Marshal(c2a)
+	if err != nil {
+		regManager.Logger.Printf("%v failed to marshal C2SWrapper payload: %v", reg.IDString(), err)
+		return
+	}
+
+	err = executeHTTPRequest(payload, apiEndpoint)
+	if err != nil {
+		regManager.Logger.Printf("%v failed to share Registration over API: %v", reg.IDString(), err)
+	}
+}
+
+func executeHTTPRequest(payload []byte, apiEndpoint string) error {
+	resp, err := http.Post(apiEndpoint, "", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to do HTTP request to registration endpoint %s: %v", apiEndpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("non-success response code %d on %s", resp.StatusCode, apiEndpoint)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestRegistration(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	c2s, keys := mockReceiveFromDetector()
+	c2s.Flags.Prescanned = proto.Bool(true)
+	regSource := pb.RegistrationSource_Detector
+	newReg := func() *DecoyRegistration {
+		reg, err := rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+		require.Nil(t, err)
+		return reg
+	}
+
+	// The phantom is blocklisted on this station.
+	conf := &Config{PhantomBlocklist: []string{"0.0.0.0/0", "::/0"}}
+	conf.parseBlocklists()
+	err = rm.IngestRegistration(context.Background(), newReg(), conf)
+	require.ErrorIs(t, err, ErrBlocklistedPhantom)
+
+	// Malformed covert address.
+	reg := newReg()
+	reg.Covert = ""
+	err = rm.IngestRegistration(context.Background(), reg, nil)
+	require.ErrorIs(t, err, ErrBlocklistedCovert)
+
+	reg = newReg()
+	require.Nil(t, rm.IngestRegistration(context.Background(), reg, nil))
+	require.Equal(t, 1, len(rm.GetRegistrations(reg.DarkDecoy)))
+
+	// Receiving the registration again refreshes it and is counted as a duplicate once.
+	dups := atomic.LoadInt64(&Stat().newDupRegistrations)
+	require.Nil(t, rm.IngestRegistration(context.Background(), newReg(), nil))
+	require.Equal(t, dups+1, atomic.LoadInt64(&Stat().newDupRegistrations))
+	require.Equal(t, 1, len(rm.GetRegistrations(reg.DarkDecoy)))
+}
@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// RegistrationRPCServer accepts registrations pushed over the network by a
+// separate ingest process. Like registrations received from the detector, those not
+// marked as prescanned are liveness tested before they are added.
+type RegistrationRPCServer struct {
+	pb.UnimplementedRegistrationServiceServer
+
+	regManager *RegistrationManager
+	conf       *Config
+}
+
+// NewRegistrationRPCServer creates a registration ingest service backed by the
+// provided manager. conf may be nil in which case no blocklists are applied.
+func NewRegistrationRPCServer(regManager *RegistrationManager, conf *Config) *RegistrationRPCServer {
+	return &RegistrationRPCServer{
+		regManager: regManager,
+		conf:       conf,
+	}
+}
+
+// Register implements pb.RegistrationServiceServer.
+func (s *RegistrationRPCServer) Register(ctx context.Context, c2sw *pb.C2SWrapper) (*pb.StationToDetector, error) {
+	if c2sw.GetRegistrationPayload() == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing registration payload")
+	}
+	if len(c2sw.GetSharedSecret()) < regIDLen/2 {
+		return nil, status.Error(codes.InvalidArgument, "shared secret undefined or insufficient length")
+	}
+
+	includeV6 := c2sw.GetRegistrationPayload().GetV6Support()
+	reg, err := s.regManager.NewRegistrationC2SWrapper(c2sw, includeV6)
+	if errors.Is(err, ErrRegistrationRateLimited) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	} else if err != nil {
+		Stat().AddErrReg()
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = s.regManager.IngestRegistration(ctx, reg, s.conf)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrRegistrationsPaused):
+		return nil, status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, ErrRegistrationBackpressure):
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrBlocklistedCovert):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrPhantomInUse), errors.Is(err, ErrBlocklistedPhantom):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return nil, status.FromContextError(err).Err()
+	default:
+		return nil, status.Errorf(codes.Internal, "error adding registration: %v", err)
+	}
+
+	phantom := reg.DarkDecoy.String()
+	client := reg.registrationAddr.String()
+	return &pb.StationToDetector{
+		PhantomIp:   &phantom,
+		PhantomPort: reg.PhantomPort,
+		ClientIp:    &client,
+	}, nil
+}
+
+// ServeRegistrationRPC listens on addr and serves the registration ingest service
+// until the listener fails. Anyone able to connect can add registrations, so unless
+// conf configures mutual TLS (registration_rpc_cert, registration_rpc_key and
+// registration_rpc_client_ca) addr must be a loopback address.
+func ServeRegistrationRPC(addr string, regManager *RegistrationManager, conf *Config) error {
+	creds, err := registrationRPCCredentials(conf)
+	if err != nil {
+		return err
+	}
+
+	var opts []grpc.ServerOption
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	} else if !isLoopbackAddr(addr) {
+		return fmt.Errorf("registration rpc address %s is not a loopback address and mutual TLS is not configured", addr)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s := grpc.NewServer(opts...)
+	pb.RegisterRegistrationServiceServer(s, NewRegistrationRPCServer(regManager, conf))
+	return s.Serve(ln)
+}
+
+// registrationRPCCredentials returns mutual TLS credentials for the registration
+// ingest service, or nil if none are configured.
+func registrationRPCCredentials(conf *Config) (credentials.TransportCredentials, error) {
+	if conf == nil || (conf.RegistrationRPCCert == "" && conf.RegistrationRPCKey == "" && conf.RegistrationRPCClientCA == "") {
+		return nil, nil
+	}
+	if conf.RegistrationRPCCert == "" || conf.RegistrationRPCKey == "" || conf.RegistrationRPCClientCA == "" {
+		return nil, errors.New("registration rpc TLS requires a certificate, key and client CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.RegistrationRPCCert, conf.RegistrationRPCKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load registration rpc certificate: %v", err)
+	}
+
+	caPEM, err := ioutil.ReadFile(conf.RegistrationRPCClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registration rpc client CA: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", conf.RegistrationRPCClientCA)
+	}
+
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+// isLoopbackAddr returns true if the host of addr (host:port) is a loopback address
+// or localhost.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func startTestRegistrationRPC(t *testing.T, rm *RegistrationManager) pb.RegistrationServiceClient {
+	ln := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	pb.RegisterRegistrationServiceServer(s, NewRegistrationRPCServer(rm, nil))
+	go s.Serve(ln)
+	t.Cleanup(s.Stop)
+
+	dialer := func(context.Context, string) (net.Conn, error) { return ln.Dial() }
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(dialer), grpc.WithInsecure())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewRegistrationServiceClient(conn)
+}
+
+func mockC2SWrapper() *pb.C2SWrapper {
+	c2s, _ := mockReceiveFromDetector()
+	// Registrations not marked as prescanned are liveness tested when received.
+	c2s.Flags.Prescanned = proto.Bool(true)
+	sharedSecret, _ := hex.DecodeString("5414c734ad5dc53e6b56a7bb47ce695a14a3ef076a3d5ace9cbf3b4d12706b73")
+	source := pb.RegistrationSource_API
+
+	return &pb.C2SWrapper{
+		SharedSecret:        sharedSecret,
+		RegistrationPayload: &c2s,
+		RegistrationSource:  &source,
+		RegistrationAddress: net.ParseIP("192.0.2.1").To16(),
+	}
+}
+
+func TestRegistrationRPCRegister(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	client := startTestRegistrationRPC(t, rm)
+
+	c2sw := mockC2SWrapper()
+	resp, err := client.Register(context.Background(), c2sw)
+	require.Nil(t, err)
+
+	phantom := net.ParseIP(resp.GetPhantomIp())
+	require.NotNil(t, phantom)
+	require.Equal(t, 1, len(rm.GetRegistrations(phantom)))
+	require.Equal(t, "192.0.2.1", resp.GetClientIp())
+
+	// A duplicate refreshes the tracked registration and is counted once.
+	dups := atomic.LoadInt64(&Stat().newDupRegistrations)
+	_, err = client.Register(context.Background(), mockC2SWrapper())
+	require.Nil(t, err)
+	require.Equal(t, dups+1, atomic.LoadInt64(&Stat().newDupRegistrations))
+	require.Equal(t, 1, len(rm.GetRegistrations(phantom)))
+}
+
+func TestRegistrationRPCLiveness(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	// Probe through the decoy so no packets are sent to the phantom.
+	rm.ProbeViaDecoy = true
+	rm.DecoyProbeDialer = func(decoy net.IP, network, address string, timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	client := startTestRegistrationRPC(t, rm)
+
+	c2sw := mockC2SWrapper()
+	c2sw.RegistrationPayload.Flags.Prescanned = proto.Bool(false)
+	c2sw.DecoyAddress = net.ParseIP("198.51.100.1").To16()
+	_, err = client.Register(context.Background(), c2sw)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// The registration stays tracked but is never marked valid.
+	for _, reg := range rm.registeredDecoys.Snapshot() {
+		require.False(t, reg.Valid)
+	}
+}
+
+func TestServeRegistrationRPCRequiresLoopback(t *testing.T) {
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+
+	// Without mutual TLS only loopback addresses are served.
+	err = ServeRegistrationRPC("0.0.0.0:0", rm, &Config{})
+	require.NotNil(t, err)
+
+	// Partial TLS configuration is rejected.
+	err = ServeRegistrationRPC("127.0.0.1:0", rm, &Config{RegistrationRPCCert: "rpc.crt"})
+	require.NotNil(t, err)
+
+	require.True(t, isLoopbackAddr("127.0.0.1:5590"))
+	require.True(t, isLoopbackAddr("[::1]:5590"))
+	require.True(t, isLoopbackAddr("localhost:5590"))
+	require.False(t, isLoopbackAddr(":5590"))
+	require.False(t, isLoopbackAddr("192.0.2.1:5590"))
+}
+
+func TestRegistrationRPCValidationFailure(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	client := startTestRegistrationRPC(t, rm)
+
+	// Unknown generation fails phantom selection.
+	c2sw := mockC2SWrapper()
+	c2sw.RegistrationPayload.DecoyListGeneration = proto.Uint32(0)
+	_, err = client.Register(context.Background(), c2sw)
+	require.NotNil(t, err)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Missing covert address.
+	c2sw = mockC2SWrapper()
+	c2sw.RegistrationPayload.CovertAddress = proto.String("")
+	_, err = client.Register(context.Background(), c2sw)
+	require.NotNil(t, err)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Missing shared secret.
+	c2sw = mockC2SWrapper()
+	c2sw.SharedSecret = nil
+	_, err = client.Register(context.Background(), c2sw)
+	require.NotNil(t, err)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestRegistrationRPCRateLimited(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+	rm.SetRegistrationRateLimit(1, 0)
+
+	client := startTestRegistrationRPC(t, rm)
+
+	_, err = client.Register(context.Background(), mockC2SWrapper())
+	require.Nil(t, err)
+
+	// A second registration from the same client address is over the limit.
+	c2sw := mockC2SWrapper()
+	c2sw.SharedSecret[0] ^= 0xff
+	_, err = client.Register(context.Background(), c2sw)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
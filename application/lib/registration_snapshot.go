@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errRegistrationExpired is returned when restoring a registration that has already
+// timed out.
+var errRegistrationExpired = errors.New("registration expired")
+
+// maxSnapshotRecord bounds the size of a single record read from a snapshot so that
+// a corrupt length prefix can not cause a huge allocation.
+const maxSnapshotRecord = 1 << 20
+
+// Save writes every tracked registration to a snapshot file at path so that they can
+// be restored with Load after the station restarts. Registrations are serialized
+// with the manager's RegistrationCodec and so contain shared secrets; the file is
+// created with mode 0600 and replaces any existing snapshot atomically.
+//
+// The snapshot starts with the name of the codec followed by one record per
+// registration, each prefixed with its length as a big endian uint32.
+func (regManager *RegistrationManager) Save(path string) error {
+	codec := regManager.RegistrationCodec
+	if codec == nil {
+		codec = GobRegistrationCodec{}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create registration snapshot: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := tmp.Chmod(0600); err != nil {
+		return fmt.Errorf("failed to create registration snapshot: %v", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	if err := writeSnapshotRecord(w, []byte(codec.Name())); err != nil {
+		return err
+	}
+	for _, reg := range regManager.registeredDecoys.Snapshot() {
+		data, err := codec.Encode(reg)
+		if err != nil {
+			return fmt.Errorf("failed to encode registration %s: %v", reg.IDString(), err)
+		}
+		if err := writeSnapshotRecord(w, data); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write registration snapshot: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to write registration snapshot: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write registration snapshot: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load restores the registrations in the snapshot file at path written by Save,
+// returning the number restored. Registrations whose original registration time is
+// already past their timeout are discarded, as are registrations that are already
+// tracked or use a transport that has not been added, so Load should be called once
+// transports are set up. Restored registrations that were valid are published to the
+// detector again, but registration observers are not notified.
+func (regManager *RegistrationManager) Load(path string) (int, error) {
+	codec := regManager.RegistrationCodec
+	if codec == nil {
+		codec = GobRegistrationCodec{}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	name, err := readSnapshotRecord(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read registration snapshot: %v", err)
+	}
+	if string(name) != codec.Name() {
+		return 0, fmt.Errorf("registration snapshot was written with the %s codec, not %s", name, codec.Name())
+	}
+
+	now := time.Now()
+	restored, expired := 0, 0
+	for {
+		data, err := readSnapshotRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return restored, fmt.Errorf("failed to read registration snapshot: %v", err)
+		}
+
+		reg, err := codec.Decode(data)
+		if err != nil {
+			return restored, fmt.Errorf("failed to decode registration: %v", err)
+		}
+
+		err = regManager.registeredDecoys.restore(reg, now, regManager.RegistrationTimeout)
+		if err == errRegistrationExpired {
+			expired++
+			continue
+		} else if err != nil {
+			regManager.Logger.Printf("not restoring registration %s: %v", reg.IDString(), err)
+			continue
+		}
+		restored++
+	}
+
+	regManager.Logger.Printf("restored %d registrations from %s (%d expired)", restored, path, expired)
+	return restored, nil
+}
+
+// SaveEvery writes a snapshot of the tracked registrations to path every interval
+// until ctx is done. Failures are logged and retried at the next interval.
+func (regManager *RegistrationManager) SaveEvery(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := regManager.Save(path); err != nil {
+				regManager.Logger.Printf("failed to save registration snapshot: %v", err)
+			}
+		}
+	}
+}
+
+// restore tracks a registration read from a snapshot with its timeout starting at
+// its original registration time, keeping its validity and receive count. It is
+// counted as active in the stats since it will be uncounted when it expires.
+func (r *RegisteredDecoys) restore(reg *DecoyRegistration, now time.Time, defaultTimeout time.Duration) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if !reg.RegistrationTime.Add(r.timeoutFor(reg.Transport, defaultTimeout)).After(now) {
+		return errRegistrationExpired
+	}
+	if r.registrationExists(reg) != nil {
+		return errors.New("already tracked")
+	}
+
+	valid, regCount := reg.Valid, reg.regCount
+	if err := r.trackAt(reg, reg.RegistrationTime); err != nil {
+		return err
+	}
+	if regCount > 0 {
+		reg.regCount = regCount
+	}
+	Stat().RestoreReg(reg.DecoyListVersion, reg.PhantomSubnet)
+
+	if valid {
+		reg.Valid = true
+		publishForDetector(r.publisher, EventRegister, reg, r.detectorEncoding)
+	}
+	return nil
+}
+
+func writeSnapshotRecord(w io.Writer, data []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	if _, err := w.Write(length[:]); err != nil {
+		return fmt.Errorf("failed to write registration snapshot: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write registration snapshot: %v", err)
+	}
+	return nil
+}
+
+func readSnapshotRecord(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxSnapshotRecord {
+		return nil, fmt.Errorf("record of %d bytes is too large", n)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
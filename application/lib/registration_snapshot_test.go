@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func newSnapshotTestManager(t *testing.T, codec RegistrationCodec) (*RegistrationManager, *recordingPublisher) {
+	rm := &RegistrationManager{
+		Logger:            log.New(ioutil.Discard, "", 0),
+		registeredDecoys:  NewRegisteredDecoys(),
+		RegistrationCodec: codec,
+	}
+	rm.registeredDecoys.transports[pb.TransportType_Null] = mockTransport{}
+	rm.registeredDecoys.transports[pb.TransportType_Min] = mockTransport{}
+
+	publisher := &recordingPublisher{}
+	rm.SetDetectorPublisher(publisher)
+	return rm, publisher
+}
+
+func TestRegistrationSnapshotRoundTrip(t *testing.T) {
+	codec, err := NewEncryptedRegistrationCodec(GobRegistrationCodec{}, bytes.Repeat([]byte{7}, 32))
+	require.Nil(t, err)
+
+	rm, _ := newSnapshotTestManager(t, codec)
+
+	reg := fullCodecRegistration(t)
+	require.Nil(t, rm.registeredDecoys.restore(reg, time.Now(), 0))
+
+	keys, err := GenSharedKeys([]byte("snapshot pending secret"))
+	require.Nil(t, err)
+	pending := &DecoyRegistration{
+		DarkDecoy:        net.ParseIP("192.0.2.20"),
+		Keys:             &keys,
+		Covert:           "192.0.2.99:443",
+		RegistrationTime: time.Now(),
+	}
+	require.Nil(t, rm.TrackRegistration(pending))
+
+	path := filepath.Join(t.TempDir(), "registrations")
+	require.Nil(t, rm.Save(path))
+
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.False(t, bytes.Contains(data, reg.Keys.SharedSecret))
+
+	restored, publisher := newSnapshotTestManager(t, codec)
+	n, err := restored.Load(path)
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, 2, restored.TotalRegistrations())
+
+	got := restored.registeredDecoys.RegistrationExists(reg)
+	require.NotNil(t, got)
+	requireSameRegistration(t, reg, got)
+	require.Equal(t, 1, len(restored.GetRegistrations(reg.DarkDecoy)))
+	require.Equal(t, 1, len(restored.GetRegistrations(reg.AltDarkDecoy)))
+
+	got = restored.registeredDecoys.RegistrationExists(pending)
+	require.NotNil(t, got)
+	require.False(t, got.Valid)
+	require.Equal(t, 0, len(restored.GetRegistrations(pending.DarkDecoy)))
+
+	// Only the valid registration is published to the detector again, once for
+	// each of its phantoms.
+	require.Equal(t, 2, publisher.count())
+
+	// Restored registrations expire based on their original registration time.
+	for _, timeout := range restored.registeredDecoys.decoysTimeouts {
+		require.True(t, timeout.registrationTime.Before(time.Now()))
+	}
+
+	// Loading again does not duplicate registrations that are already tracked.
+	n, err = restored.Load(path)
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, 2, restored.TotalRegistrations())
+}
+
+func TestRegistrationSnapshotDropsExpired(t *testing.T) {
+	rm, _ := newSnapshotTestManager(t, GobRegistrationCodec{})
+	rm.RegistrationTimeout = time.Hour
+
+	var regs []*DecoyRegistration
+	for i, age := range []time.Duration{time.Minute, 2 * time.Hour} {
+		keys, err := GenSharedKeys([]byte{byte(i), 's', 'n', 'a', 'p'})
+		require.Nil(t, err)
+		reg := &DecoyRegistration{
+			DarkDecoy:        net.ParseIP("192.0.2.30"),
+			Keys:             &keys,
+			RegistrationTime: time.Now().Add(-age),
+		}
+		require.Nil(t, rm.AddRegistration(reg))
+		regs = append(regs, reg)
+	}
+
+	path := filepath.Join(t.TempDir(), "registrations")
+	require.Nil(t, rm.Save(path))
+
+	restored, _ := newSnapshotTestManager(t, GobRegistrationCodec{})
+	restored.RegistrationTimeout = time.Hour
+	n, err := restored.Load(path)
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	require.NotNil(t, restored.registeredDecoys.RegistrationExists(regs[0]))
+	require.Nil(t, restored.registeredDecoys.RegistrationExists(regs[1]))
+
+	// A snapshot written with a different codec is rejected.
+	restored, _ = newSnapshotTestManager(t, JSONRegistrationCodec{})
+	_, err = restored.Load(path)
+	require.NotNil(t, err)
+}
+
+func TestRegistrationSnapshotStatsBalanced(t *testing.T) {
+	rm, _ := newSnapshotTestManager(t, GobRegistrationCodec{})
+
+	keys, err := GenSharedKeys([]byte("snapshot stats secret"))
+	require.Nil(t, err)
+	subnet := "203.0.113.64/26"
+	reg := &DecoyRegistration{
+		DarkDecoy:        net.ParseIP("203.0.113.70"),
+		PhantomSubnet:    subnet,
+		Keys:             &keys,
+		RegistrationTime: time.Now(),
+	}
+	require.Nil(t, rm.AddRegistration(reg))
+
+	path := filepath.Join(t.TempDir(), "registrations")
+	require.Nil(t, rm.Save(path))
+
+	active := atomic.LoadInt64(&Stat().activeRegistrations)
+	bySubnet := Stat().ActiveRegistrationsBySubnet()[subnet]
+
+	// Restored registrations are counted as active...
+	restored, _ := newSnapshotTestManager(t, GobRegistrationCodec{})
+	n, err := restored.Load(path)
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, active+1, atomic.LoadInt64(&Stat().activeRegistrations))
+	require.Equal(t, bySubnet+1, Stat().ActiveRegistrationsBySubnet()[subnet])
+
+	// ...so the counts are back where they were once they expire.
+	restored.RegistrationTimeout = time.Nanosecond
+	restored.RemoveOldRegistrations()
+	require.Equal(t, 0, restored.TotalRegistrations())
+	require.Equal(t, active, atomic.LoadInt64(&Stat().activeRegistrations))
+	require.Equal(t, bySubnet, Stat().ActiveRegistrationsBySubnet()[subnet])
+}
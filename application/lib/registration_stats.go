@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RegistrationStats is a point in time summary of the registrations tracked by a
+// RegistrationManager, suitable for serving directly from admin and metrics endpoints.
+type RegistrationStats struct {
+	Total        int            `json:"total"`
+	Valid        int            `json:"valid"`
+	ByFamily     map[string]int `json:"by_family"`
+	ByGeneration map[uint32]int `json:"by_generation"`
+	ByTransport  map[string]int `json:"by_transport"`
+
+	Liveness LivenessStats `json:"liveness"`
+	Publish  PublishStats  `json:"publish"`
+	Capacity CapacityStats `json:"capacity"`
+	Dropped  DroppedStats  `json:"dropped"`
+
+	// NextEviction is when the oldest tracked registration expires, nil if no
+	// registrations are tracked.
+	NextEviction *time.Time `json:"next_eviction,omitempty"`
+}
+
+// LivenessStats summarizes the phantom liveness results currently cached.
+type LivenessStats struct {
+	CachedLive int `json:"cached_live"`
+	CachedDead int `json:"cached_dead"`
+	InFlight   int `json:"in_flight"`
+}
+
+// PublishStats summarizes the health of publishing registration events to the
+// detector since the station started.
+type PublishStats struct {
+	Published     int64      `json:"published"`
+	Failed        int64      `json:"failed"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+}
+
+// DroppedStats counts registrations and callbacks the station dropped, and id prefix
+// collisions between active registrations, since the station started.
+type DroppedStats struct {
+	Vetoed           int64 `json:"vetoed"`
+	Backpressure     int64 `json:"backpressure"`
+	RateLimited      int64 `json:"rate_limited"`
+	DroppedCallbacks int64 `json:"dropped_callbacks"`
+	IDCollisions     int64 `json:"id_collisions"`
+}
+
+// CapacityStats describes how full the registration table is. Max and Utilization
+// are zero when the table is unbounded.
+type CapacityStats struct {
+	Tracked     int     `json:"tracked"`
+	Max         int     `json:"max"`
+	Utilization float64 `json:"utilization"`
+}
+
+// Stats returns a summary of the registrations tracked by the manager.
+func (regManager *RegistrationManager) Stats() RegistrationStats {
+	stats := regManager.registeredDecoys.stats(regManager.RegistrationTimeout)
+
+	if regManager.livenessLimiter != nil {
+		stats.Liveness = regManager.livenessLimiter.stats()
+	}
+
+	s := Stat()
+	stats.Publish = PublishStats{
+		Published: atomic.LoadInt64(&s.detectorPublishes),
+		Failed:    atomic.LoadInt64(&s.detectorPublishErrors),
+	}
+	stats.Dropped = DroppedStats{
+		Vetoed:           atomic.LoadInt64(&s.vetoedRegistrations),
+		Backpressure:     atomic.LoadInt64(&s.backpressureRegistrations),
+		RateLimited:      atomic.LoadInt64(&s.rateLimitedRegistrations),
+		DroppedCallbacks: atomic.LoadInt64(&s.droppedCallbacks),
+		IDCollisions:     atomic.LoadInt64(&s.idCollisions),
+	}
+	if last := atomic.LoadInt64(&s.lastDetectorPublishErr); last != 0 {
+		t := time.Unix(0, last)
+		stats.Publish.LastFailureAt = &t
+	}
+
+	return stats
+}
+
+func (r *RegisteredDecoys) stats(defaultTimeout time.Duration) RegistrationStats {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	stats := RegistrationStats{
+		ByFamily:     map[string]int{},
+		ByGeneration: map[uint32]int{},
+		ByTransport:  map[string]int{},
+	}
+
+	var next time.Time
+	for _, queue := range r.expiryQueues {
+		if queue.Len() == 0 {
+			continue
+		}
+		if expires := r.expiresAt((*queue)[0], defaultTimeout); next.IsZero() || expires.Before(next) {
+			next = expires
+		}
+	}
+	if !next.IsZero() {
+		stats.NextEviction = &next
+	}
+
+	for _, regSet := range r.decoys {
+		for _, reg := range regSet {
+			stats.Total++
+			if reg.Valid {
+				stats.Valid++
+			}
+
+			if reg.DarkDecoy.To4() != nil {
+				stats.ByFamily["v4"]++
+			} else {
+				stats.ByFamily["v6"]++
+			}
+			stats.ByGeneration[reg.DecoyListVersion]++
+			stats.ByTransport[reg.Transport.String()]++
+		}
+	}
+
+	stats.Capacity = CapacityStats{
+		Tracked: len(r.decoysTimeouts),
+		Max:     r.maxTracked,
+	}
+	if r.maxTracked > 0 {
+		stats.Capacity.Utilization = float64(len(r.decoysTimeouts)) / float64(r.maxTracked)
+	}
+
+	return stats
+}
+
+func (l *phantomProbeLimiter) stats() LivenessStats {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	var stats LivenessStats
+	for _, p := range l.probes {
+		select {
+		case <-p.done:
+			if !l.fresh(p) {
+				continue
+			}
+			if p.live {
+				stats.CachedLive++
+			} else {
+				stats.CachedDead++
+			}
+		default:
+			stats.InFlight++
+		}
+	}
+	return stats
+}
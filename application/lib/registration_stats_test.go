@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrationStatsJSON(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+		livenessLimiter:  newPhantomProbeLimiter(time.Hour),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	rm.SetDetectorPublisher(&recordingPublisher{})
+	rm.SetMaxTrackedRegistrations(4)
+
+	v4 := &DecoyRegistration{
+		DarkDecoy:        net.ParseIP("192.0.2.1"),
+		Keys:             &ConjureSharedKeys{SharedSecret: []byte("stats v4 secret")},
+		DecoyListVersion: 1,
+	}
+	v6 := &DecoyRegistration{
+		DarkDecoy:        net.ParseIP("2001:db8::1"),
+		Keys:             &ConjureSharedKeys{SharedSecret: []byte("stats v6 secret")},
+		DecoyListVersion: 2,
+	}
+	require.Nil(t, rm.AddRegistration(v4))
+	require.Nil(t, rm.TrackRegistration(v6))
+
+	_, _ = rm.livenessLimiter.check(v4.DarkDecoy, "192.0.2.1:443", func(string) (bool, error) { return false, nil })
+
+	data, err := json.Marshal(rm.Stats())
+	require.Nil(t, err)
+
+	var shape map[string]interface{}
+	require.Nil(t, json.Unmarshal(data, &shape))
+
+	require.Equal(t, float64(2), shape["total"])
+	require.Equal(t, float64(1), shape["valid"])
+	require.Equal(t, map[string]interface{}{"v4": float64(1), "v6": float64(1)}, shape["by_family"])
+	require.Equal(t, map[string]interface{}{"1": float64(1), "2": float64(1)}, shape["by_generation"])
+	require.Equal(t, map[string]interface{}{pb.TransportType(0).String(): float64(2)}, shape["by_transport"])
+	require.Equal(t, map[string]interface{}{"cached_live": float64(0), "cached_dead": float64(1), "in_flight": float64(0)}, shape["liveness"])
+	require.Equal(t, map[string]interface{}{"tracked": float64(2), "max": float64(4), "utilization": 0.5}, shape["capacity"])
+
+	publish, ok := shape["publish"].(map[string]interface{})
+	require.True(t, ok)
+	require.Contains(t, publish, "published")
+	require.Contains(t, publish, "failed")
+
+	dropped, ok := shape["dropped"].(map[string]interface{})
+	require.True(t, ok)
+	for _, key := range []string{"vetoed", "backpressure", "rate_limited", "dropped_callbacks", "id_collisions"} {
+		require.Contains(t, dropped, key)
+	}
+
+	nextEviction, ok := shape["next_eviction"].(string)
+	require.True(t, ok)
+	next, err := time.Parse(time.RFC3339Nano, nextEviction)
+	require.Nil(t, err)
+	require.WithinDuration(t, time.Now().Add(regTimeout), next, time.Minute)
+
+	// An empty manager has nothing to evict.
+	empty := &RegistrationManager{registeredDecoys: NewRegisteredDecoys()}
+	data, err = json.Marshal(empty.Stats())
+	require.Nil(t, err)
+	shape = nil
+	require.Nil(t, json.Unmarshal(data, &shape))
+	require.NotContains(t, shape, "next_eviction")
+}
+
+func TestRegistrationCounts(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	// Counting does not race with registrations being added and removed.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				rm.TotalRegistrations()
+				rm.RegistrationsByFamily()
+			}
+		}
+	}()
+
+	var adders sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		adders.Add(1)
+		go func(i int) {
+			defer adders.Done()
+			phantom := fmt.Sprintf("192.0.2.%d", i+1)
+			if i%2 == 1 {
+				phantom = fmt.Sprintf("2001:db8::%d", i+1)
+			}
+			require.Nil(t, rm.AddRegistration(&DecoyRegistration{
+				DarkDecoy: net.ParseIP(phantom),
+				Keys:      &ConjureSharedKeys{SharedSecret: []byte(fmt.Sprintf("%d count secret", i))},
+			}))
+			rm.RemoveOldRegistrations()
+		}(i)
+	}
+	adders.Wait()
+	close(done)
+	wg.Wait()
+
+	require.Equal(t, 10, rm.TotalRegistrations())
+	v4, v6 := rm.RegistrationsByFamily()
+	require.Equal(t, 5, v4)
+	require.Equal(t, 5, v6)
+
+	for _, timeout := range rm.registeredDecoys.decoysTimeouts {
+		timeout.registrationTime = time.Now().Add(-7 * time.Hour)
+	}
+	rm.RemoveOldRegistrations()
+	require.Equal(t, 0, rm.TotalRegistrations())
+	v4, v6 = rm.RegistrationsByFamily()
+	require.Equal(t, 0, v4)
+	require.Equal(t, 0, v6)
+}
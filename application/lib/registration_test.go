@@ -2,10 +2,19 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -73,17 +82,18 @@ func mockReceiveFromDetector() (pb.ClientToStation, ConjureSharedKeys) {
 // }
 
 func TestRegistrationLookup(t *testing.T) {
-	rm := NewRegistrationManager()
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
 
 	// The mock registration has transport id 0, so we hard code that here too
-	err := rm.AddTransport(0, mockTransport{})
+	err = rm.AddTransport(0, mockTransport{})
 	require.Nil(t, err)
 
 	c2s, keys := mockReceiveFromDetector()
 
 	regSource := pb.RegistrationSource_Detector
 
-	newReg, err := rm.NewRegistration(&c2s, &keys, c2s.GetV6Support(), &regSource)
+	newReg, err := rm.NewRegistration(&c2s, &keys, c2s.GetV6Support(), &regSource, nil)
 	if err != nil {
 		t.Fatalf("Registration failed: %v", err)
 	}
@@ -98,6 +108,39 @@ func TestRegistrationLookup(t *testing.T) {
 	}
 }
 
+func TestRegistrationTransport(t *testing.T) {
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_Detector
+
+	transport := pb.TransportType_Min
+	c2s.Transport = &transport
+	reg, err := rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+	require.Nil(t, err)
+	require.Equal(t, pb.TransportType_Min, reg.Transport)
+
+	payload, err := reg.DetectorPayload(DetectorEncodingJSON)
+	require.Nil(t, err)
+	var decoded detectorJSONPayload
+	require.Nil(t, json.Unmarshal(payload, &decoded))
+	require.Equal(t, "Min", decoded.Transport)
+
+	// Unrecognized transports are rejected rather than treated as the default.
+	unknown := pb.TransportType(42)
+	c2s.Transport = &unknown
+	_, err = rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+	require.NotNil(t, err)
+
+	c2sw := &pb.C2SWrapper{
+		SharedSecret:        []byte("unknown transport secret"),
+		RegistrationPayload: &c2s,
+	}
+	_, err = rm.NewRegistrationC2SWrapper(c2sw, false)
+	require.NotNil(t, err)
+}
+
 func TestLivenessCheck(t *testing.T) {
 	phantomAddr := net.ParseIP("1.1.1.1")
 	reg := DecoyRegistration{
@@ -172,7 +215,7 @@ func TestRegisterForDetectorOnce(t *testing.T) {
 	channel := pubsub.Channel()
 
 	// send message to redis pubsub, wait, then close subscriber & channel
-	registerForDetector(&reg)
+	publishForDetector(redisPublisher{}, EventRegister, &reg, DetectorEncodingBinary)
 
 	time.AfterFunc(time.Second*1, func() {
 		_ = pubsub.Close()
@@ -230,7 +273,7 @@ func TestRegisterForDetectorArray(t *testing.T) {
 		}
 
 		// send message to redis pubsub, wait, then close subscriber & channel
-		registerForDetector(reg)
+		publishForDetector(redisPublisher{}, EventRegister, reg, DetectorEncodingBinary)
 
 		// check message
 		msg := <-channel
@@ -290,7 +333,7 @@ func TestRegisterForDetectorMultithread(t *testing.T) {
 
 		// send message to redis pubsub, wait, then close subscriber & channel
 		go func() {
-			registerForDetector(reg)
+			publishForDetector(redisPublisher{}, EventRegister, reg, DetectorEncodingBinary)
 		}()
 	}
 
@@ -330,16 +373,1029 @@ func TestRegisterForDetectorMultithread(t *testing.T) {
 }
 
 func TestRegString(t *testing.T) {
-	rm := NewRegistrationManager()
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
 
 	c2s, keys := mockReceiveFromDetector()
 
 	regSource := pb.RegistrationSource_Detector
 
-	newReg, err := rm.NewRegistration(&c2s, &keys, c2s.GetV6Support(), &regSource)
+	newReg, err := rm.NewRegistration(&c2s, &keys, c2s.GetV6Support(), &regSource, nil)
 	if err != nil {
 		t.Fatalf("Registration failed: %v", err)
 	}
 
 	t.Logf("%s - %s", newReg.IDString(), newReg.String())
 }
+
+func TestRegStringNil(t *testing.T) {
+	var reg *DecoyRegistration
+	require.Equal(t, "<nil registration>", reg.String())
+	require.Equal(t, "<nil registration>", fmt.Sprintf("%v", reg))
+
+	// A registration without keys prints the zero id like IDString.
+	reg = &DecoyRegistration{DarkDecoy: net.ParseIP("192.0.2.1")}
+	require.Contains(t, reg.String(), `"RegID":"`+reg.IDString()+`"`)
+	require.Contains(t, reg.String(), `"Phantom":"192.0.2.1"`)
+}
+
+func TestRegistrationExpiryTickStats(t *testing.T) {
+	r := NewRegisteredDecoys()
+	r.transports[0] = mockTransport{}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	_, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_Detector
+	reg := &DecoyRegistration{
+		DarkDecoy:          net.ParseIP("192.0.2.10"),
+		Keys:               &keys,
+		RegistrationSource: &regSource,
+	}
+	require.Nil(t, r.Track(reg))
+
+	// Backdate the registration so that the next tick evicts it.
+	for _, timeout := range r.decoysTimeouts {
+		timeout.registrationTime = time.Now().Add(-7 * time.Hour)
+	}
+
+	atomic.StoreInt64(&Stat().tickDurationNs, -1)
+	r.removeOldRegistrations(logger, 0)
+	require.Equal(t, int64(1), atomic.LoadInt64(&Stat().tickEvictions))
+	require.GreaterOrEqual(t, atomic.LoadInt64(&Stat().tickDurationNs), int64(0))
+	require.Equal(t, 0, r.TotalRegistrations())
+
+	// A tick with nothing to expire records zero evictions.
+	r.removeOldRegistrations(logger, 0)
+	require.Equal(t, int64(0), atomic.LoadInt64(&Stat().tickEvictions))
+}
+
+func TestRegistrationSubnetStats(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+
+	genA := rm.PhantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.0.2.0/24"}}},
+	})
+	genB := rm.PhantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"198.51.100.0/24"}}},
+	})
+
+	before := Stat().ActiveRegistrationsBySubnet()
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_Detector
+	for _, gen := range []uint{genA, genA, genB} {
+		g := uint32(gen)
+		c2s.DecoyListGeneration = &g
+		reg, err := rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+		require.Nil(t, err)
+		Stat().AddReg(reg.DecoyListVersion, reg.RegistrationSource, reg.PhantomSubnet)
+	}
+
+	after := Stat().ActiveRegistrationsBySubnet()
+	require.Equal(t, before["192.0.2.0/24"]+2, after["192.0.2.0/24"])
+	require.Equal(t, before["198.51.100.0/24"]+1, after["198.51.100.0/24"])
+
+	Stat().ExpireReg(uint32(genB), &regSource, "198.51.100.0/24")
+	require.Equal(t, before["198.51.100.0/24"], Stat().ActiveRegistrationsBySubnet()["198.51.100.0/24"])
+}
+
+func TestFormatSubnetCounts(t *testing.T) {
+	require.Equal(t, "none", formatSubnetCounts(nil))
+	require.Equal(t, "none", formatSubnetCounts(map[string]int64{"192.0.2.0/24": 0}))
+
+	counts := map[string]int64{
+		"2001:db8::/32":   2,
+		"192.0.2.0/24":    3,
+		"198.51.100.0/24": 0,
+		"unknown":         1,
+	}
+	require.Equal(t, "192.0.2.0/24 3, 2001:db8::/32 2, unknown 1", formatSubnetCounts(counts))
+}
+
+func TestRegistrationV6SupportPolicy(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+
+	newC2SW := func(v6Support bool, clientAddr string) *pb.C2SWrapper {
+		c2s, keys := mockReceiveFromDetector()
+		gen := uint32(1)
+		c2s.DecoyListGeneration = &gen
+		c2s.V6Support = &v6Support
+		return &pb.C2SWrapper{
+			SharedSecret:        keys.SharedSecret,
+			RegistrationPayload: &c2s,
+			RegistrationAddress: net.ParseIP(clientAddr).To16(),
+		}
+	}
+
+	for _, policy := range []V6SupportPolicy{V6SupportRequireConsistent, V6SupportHonor} {
+		rm.V6SupportPolicy = policy
+
+		// Consistent combinations are accepted under any policy.
+		reg, err := rm.NewRegistrationC2SWrapper(newC2SW(false, "192.0.2.1"), false)
+		require.Nil(t, err)
+		require.NotNil(t, reg.DarkDecoy.To4())
+
+		reg, err = rm.NewRegistrationC2SWrapper(newC2SW(true, "2001:db8::1"), true)
+		require.Nil(t, err)
+		require.Nil(t, reg.DarkDecoy.To4())
+	}
+
+	// v6 phantom requested for a client that did not advertise v6 support.
+	rm.V6SupportPolicy = V6SupportRequireConsistent
+	_, err = rm.NewRegistrationC2SWrapper(newC2SW(false, "192.0.2.1"), true)
+	require.NotNil(t, err)
+
+	rm.V6SupportPolicy = V6SupportHonor
+	reg, err := rm.NewRegistrationC2SWrapper(newC2SW(false, "192.0.2.1"), true)
+	require.Nil(t, err)
+	require.NotNil(t, reg.DarkDecoy.To4())
+
+	// IPv6 client that ends up with an IPv4 phantom.
+	rm.V6SupportPolicy = V6SupportRequireConsistent
+	_, err = rm.NewRegistrationC2SWrapper(newC2SW(true, "2001:db8::1"), false)
+	require.NotNil(t, err)
+
+	rm.V6SupportPolicy = V6SupportHonor
+	reg, err = rm.NewRegistrationC2SWrapper(newC2SW(true, "2001:db8::1"), false)
+	require.Nil(t, err)
+	require.NotNil(t, reg.DarkDecoy.To4())
+
+	// The policy applies the same way to registrations created with NewRegistration.
+	c2sw := newC2SW(false, "192.0.2.1")
+	keys, err := GenSharedKeys(c2sw.SharedSecret)
+	require.Nil(t, err)
+	source := pb.RegistrationSource_Detector
+
+	rm.V6SupportPolicy = V6SupportRequireConsistent
+	_, err = rm.NewRegistration(c2sw.RegistrationPayload, &keys, true, &source, nil)
+	require.NotNil(t, err)
+	_, err = rm.NewRegistration(c2sw.RegistrationPayload, &keys, false, &source, net.ParseIP("2001:db8::1"))
+	require.NotNil(t, err)
+
+	rm.V6SupportPolicy = V6SupportHonor
+	reg, err = rm.NewRegistration(c2sw.RegistrationPayload, &keys, true, &source, nil)
+	require.Nil(t, err)
+	require.NotNil(t, reg.DarkDecoy.To4())
+	_, err = rm.NewRegistration(c2sw.RegistrationPayload, &keys, false, &source, net.ParseIP("2001:db8::1"))
+	require.Nil(t, err)
+
+	_, err = ParseV6SupportPolicy("sometimes")
+	require.NotNil(t, err)
+}
+
+func TestRegistrationUpdateCovert(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_Detector
+	reg, err := rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+	require.Nil(t, err)
+	require.Nil(t, rm.TrackRegistration(reg))
+
+	phantom := reg.DarkDecoy.String()
+
+	err = rm.UpdateCovert(keys.SharedSecret, "192.0.2.44:8443")
+	require.Nil(t, err)
+
+	tracked := rm.registeredDecoys.RegistrationExists(reg)
+	require.NotNil(t, tracked)
+	require.Equal(t, "192.0.2.44:8443", tracked.Covert)
+	require.Equal(t, phantom, tracked.DarkDecoy.String())
+	require.Equal(t, keys.SharedSecret, tracked.Keys.SharedSecret)
+
+	// Malformed covert addresses are rejected and leave the registration unchanged.
+	err = rm.UpdateCovert(keys.SharedSecret, "not-a-host-port")
+	require.NotNil(t, err)
+	require.Equal(t, "192.0.2.44:8443", tracked.Covert)
+
+	// Unknown secrets are reported.
+	err = rm.UpdateCovert([]byte("unknown secret"), "192.0.2.44:8443")
+	require.NotNil(t, err)
+}
+
+func TestRegistrationIDCollisionWarning(t *testing.T) {
+	r := NewRegisteredDecoys()
+	r.transports[0] = mockTransport{}
+
+	secret1, _ := hex.DecodeString("abcdef0123456789aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	secret2, _ := hex.DecodeString("abcdef0123456789bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	secret3, _ := hex.DecodeString("abcdef9999999999cccccccccccccccccccccccccccccccccccccccccccccccc")
+
+	newReg := func(secret []byte, phantom string) *DecoyRegistration {
+		return &DecoyRegistration{
+			DarkDecoy: net.ParseIP(phantom),
+			Keys:      &ConjureSharedKeys{SharedSecret: secret},
+		}
+	}
+
+	before := atomic.LoadInt64(&Stat().idCollisions)
+
+	// The same secret on v4 and v6 phantoms is not a collision.
+	require.Nil(t, r.Track(newReg(secret1, "192.0.2.1")))
+	require.Nil(t, r.Track(newReg(secret1, "2001:db8::1")))
+	require.Equal(t, before, atomic.LoadInt64(&Stat().idCollisions))
+
+	// A different secret with the same logged id is.
+	reg2 := newReg(secret2, "192.0.2.2")
+	require.Equal(t, newReg(secret1, "").IDString(), reg2.IDString())
+	require.Nil(t, r.Track(reg2))
+	require.Equal(t, before+1, atomic.LoadInt64(&Stat().idCollisions))
+
+	// Secrets that only share a shorter prefix collide once the compared prefix
+	// length is narrowed.
+	require.Nil(t, r.Track(newReg(secret3, "192.0.2.3")))
+	require.Equal(t, before+1, atomic.LoadInt64(&Stat().idCollisions))
+
+	r.SetIDCollisionPrefixLen(6)
+	require.Equal(t, 3, len(r.idPrefixes["abcdef"]))
+}
+
+func TestRegistrationPauseResume(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_Detector
+	existing, err := rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+	require.Nil(t, err)
+	require.Nil(t, rm.AddRegistration(existing))
+
+	rm.Pause()
+	require.True(t, rm.Paused())
+
+	_, otherKeys := mockReceiveFromDetector()
+	otherKeys.SharedSecret = []byte("another shared secret for pausing")
+	newReg, err := rm.NewRegistration(&c2s, &otherKeys, false, &regSource, nil)
+	require.Nil(t, err)
+
+	err = rm.AddRegistration(newReg)
+	require.Equal(t, ErrRegistrationsPaused, err)
+	require.False(t, rm.RegistrationExists(newReg))
+
+	// Existing registrations keep serving while paused.
+	require.True(t, rm.RegistrationExists(existing))
+	require.Equal(t, 1, len(rm.GetRegistrations(existing.DarkDecoy)))
+	require.Nil(t, rm.AddRegistration(existing))
+
+	rm.Resume()
+	require.False(t, rm.Paused())
+	require.Nil(t, rm.AddRegistration(newReg))
+	require.True(t, rm.RegistrationExists(newReg))
+}
+
+func TestRegistrationDetectorPayloadEncoding(t *testing.T) {
+	for _, phantom := range []string{"192.0.2.10", "2001:db8::10"} {
+		reg := &DecoyRegistration{
+			DarkDecoy:        net.ParseIP(phantom),
+			PhantomPort:      443,
+			registrationAddr: net.ParseIP("198.51.100.1"),
+			DecoyListVersion: 957,
+		}
+
+		payload, err := reg.DetectorPayload(DetectorEncodingBinary)
+		require.Nil(t, err)
+		parsed := &pb.StationToDetector{}
+		require.Nil(t, proto.Unmarshal(payload, parsed))
+		require.Equal(t, phantom, parsed.GetPhantomIp())
+		require.Equal(t, uint32(443), parsed.GetPhantomPort())
+		require.Equal(t, "198.51.100.1", parsed.GetClientIp())
+
+		payload, err = reg.DetectorPayload(DetectorEncodingJSON)
+		require.Nil(t, err)
+		var parsedJSON struct {
+			Phantom    string `json:"phantom"`
+			Generation uint32 `json:"generation"`
+		}
+		require.Nil(t, json.Unmarshal(payload, &parsedJSON))
+		require.Equal(t, phantom, parsedJSON.Phantom)
+		require.Equal(t, uint32(957), parsedJSON.Generation)
+	}
+
+	enc, err := ParseDetectorEncoding("")
+	require.Nil(t, err)
+	require.Equal(t, DetectorEncodingBinary, enc)
+	enc, err = ParseDetectorEncoding("json")
+	require.Nil(t, err)
+	require.Equal(t, DetectorEncodingJSON, enc)
+	_, err = ParseDetectorEncoding("xml")
+	require.NotNil(t, err)
+}
+
+func TestRegistrationAcceptHooks(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	vetoErr := fmt.Errorf("over quota")
+	var calls []string
+	rm.AcceptHooks = []AcceptHook{
+		func(reg *DecoyRegistration) error {
+			calls = append(calls, "allow")
+			return nil
+		},
+		func(reg *DecoyRegistration) error {
+			calls = append(calls, "veto")
+			if reg.Covert == "192.0.2.66:443" {
+				return vetoErr
+			}
+			return nil
+		},
+		func(reg *DecoyRegistration) error {
+			calls = append(calls, "after")
+			return nil
+		},
+	}
+
+	c2s, keys := mockReceiveFromDetector()
+	regSource := pb.RegistrationSource_Detector
+	allowed, err := rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+	require.Nil(t, err)
+	require.Nil(t, rm.AddRegistration(allowed))
+	require.True(t, rm.RegistrationExists(allowed))
+	require.Equal(t, []string{"allow", "veto", "after"}, calls)
+
+	calls = nil
+	before := atomic.LoadInt64(&Stat().vetoedRegistrations)
+	_, otherKeys := mockReceiveFromDetector()
+	otherKeys.SharedSecret = []byte("another shared secret for vetoing")
+	vetoed, err := rm.NewRegistration(&c2s, &otherKeys, false, &regSource, nil)
+	require.Nil(t, err)
+	vetoed.Covert = "192.0.2.66:443"
+
+	err = rm.AddRegistration(vetoed)
+	require.True(t, errors.Is(err, vetoErr))
+	require.False(t, rm.RegistrationExists(vetoed))
+	require.Equal(t, []string{"allow", "veto"}, calls)
+	require.Equal(t, before+1, atomic.LoadInt64(&Stat().vetoedRegistrations))
+}
+
+func TestRegistrationFindByCovert(t *testing.T) {
+	rm := &RegistrationManager{registeredDecoys: NewRegisteredDecoys()}
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	coverts := []string{"192.0.2.1:443", "192.0.2.2:443", "192.0.2.1:443", "example.com:443", "192.0.2.1:443"}
+	for i, covert := range coverts {
+		reg := &DecoyRegistration{
+			DarkDecoy: net.ParseIP(fmt.Sprintf("198.51.100.%d", i)),
+			Keys:      &ConjureSharedKeys{SharedSecret: []byte(fmt.Sprintf("shared secret %d", i))},
+			Covert:    covert,
+		}
+		require.Nil(t, rm.TrackRegistration(reg))
+	}
+
+	found := rm.FindByCovert("192.0.2.1:443")
+	require.Equal(t, 3, len(found))
+	for _, reg := range found {
+		require.Equal(t, "192.0.2.1:443", reg.Covert)
+	}
+
+	require.Equal(t, 1, len(rm.FindByCovert("example.com:443")))
+	require.Empty(t, rm.FindByCovert("192.0.2.3:443"))
+
+	// Results are copies that are not changed by later covert updates.
+	require.Nil(t, rm.UpdateCovert([]byte("shared secret 0"), "192.0.2.3:443"))
+	for _, reg := range found {
+		require.Equal(t, "192.0.2.1:443", reg.Covert)
+	}
+	require.Equal(t, 2, len(rm.FindByCovert("192.0.2.1:443")))
+}
+
+func TestRegistrationBackpressure(t *testing.T) {
+	rm := &RegistrationManager{registeredDecoys: NewRegisteredDecoys()}
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	limit := 50
+	rm.SetMaxTrackedRegistrations(limit)
+	before := atomic.LoadInt64(&Stat().backpressureRegistrations)
+
+	// Flood registrations with no expiry running.
+	rejected := 0
+	for i := 0; i < 4*limit; i++ {
+		reg := &DecoyRegistration{
+			DarkDecoy: net.ParseIP(fmt.Sprintf("192.0.2.%d", i%256)),
+			Keys:      &ConjureSharedKeys{SharedSecret: []byte(fmt.Sprintf("flood shared secret %d", i))},
+		}
+		err := rm.TrackRegistration(reg)
+		if err != nil {
+			require.Equal(t, ErrRegistrationBackpressure, err)
+			rejected++
+		}
+	}
+
+	require.Equal(t, limit, rm.registeredDecoys.TotalRegistrations())
+	require.Equal(t, 3*limit, rejected)
+	require.Equal(t, before+int64(3*limit), atomic.LoadInt64(&Stat().backpressureRegistrations))
+
+	// Once registrations expire new ones are accepted again.
+	for _, timeout := range rm.registeredDecoys.decoysTimeouts {
+		timeout.registrationTime = time.Now().Add(-7 * time.Hour)
+	}
+	rm.registeredDecoys.removeOldRegistrations(log.New(ioutil.Discard, "", 0), 0)
+
+	reg := &DecoyRegistration{
+		DarkDecoy: net.ParseIP("192.0.2.1"),
+		Keys:      &ConjureSharedKeys{SharedSecret: []byte("shared secret after expiry")},
+	}
+	require.Nil(t, rm.TrackRegistration(reg))
+}
+
+func TestRegistrationTrustedSourceBypass(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+	require.Nil(t, rm.SetTrustedSources([]string{"192.0.2.0/24"}))
+	require.NotNil(t, rm.SetTrustedSources([]string{"not a subnet"}))
+	require.Nil(t, rm.SetTrustedSources([]string{"192.0.2.0/24"}))
+
+	limit := 2
+	rm.SetMaxTrackedRegistrations(limit)
+
+	newC2SW := func(i int, clientAddr string) *pb.C2SWrapper {
+		c2s, _ := mockReceiveFromDetector()
+		return &pb.C2SWrapper{
+			SharedSecret:        []byte(fmt.Sprintf("trusted source shared secret %d", i)),
+			RegistrationPayload: &c2s,
+			RegistrationAddress: net.ParseIP(clientAddr).To16(),
+		}
+	}
+
+	// Fill the registration table from an untrusted source.
+	for i := 0; i < limit; i++ {
+		reg, err := rm.NewRegistrationC2SWrapper(newC2SW(i, "198.51.100.1"), false)
+		require.Nil(t, err)
+		require.Nil(t, rm.TrackRegistration(reg))
+	}
+
+	reg, err := rm.NewRegistrationC2SWrapper(newC2SW(limit, "198.51.100.1"), false)
+	require.Nil(t, err)
+	require.Equal(t, ErrRegistrationBackpressure, rm.TrackRegistration(reg))
+
+	// Trusted sources are accepted past the limit.
+	for i := limit + 1; i < 3*limit; i++ {
+		reg, err := rm.NewRegistrationC2SWrapper(newC2SW(i, "192.0.2.25"), false)
+		require.Nil(t, err)
+		require.Nil(t, rm.TrackRegistration(reg))
+		require.Nil(t, rm.AddRegistration(reg))
+	}
+	require.Equal(t, 3*limit-1, rm.registeredDecoys.TotalRegistrations())
+}
+
+func TestRegistrationFingerprint(t *testing.T) {
+	newReg := func(secret, phantom string, generation uint32) *DecoyRegistration {
+		return &DecoyRegistration{
+			DarkDecoy:        net.ParseIP(phantom),
+			Keys:             &ConjureSharedKeys{SharedSecret: []byte(secret)},
+			DecoyListVersion: generation,
+			RegistrationTime: time.Now(),
+		}
+	}
+
+	reg := newReg("fingerprint secret", "192.0.2.1", 957)
+
+	// Identical registrations received at different times match.
+	same := newReg("fingerprint secret", "192.0.2.1", 957)
+	same.RegistrationTime = time.Now().Add(time.Hour)
+	same.Covert = "192.0.2.99:443"
+	require.Equal(t, reg.Fingerprint(), same.Fingerprint())
+
+	// Any difference in secret, phantom or generation does not.
+	require.NotEqual(t, reg.Fingerprint(), newReg("fingerprint secret 2", "192.0.2.1", 957).Fingerprint())
+	require.NotEqual(t, reg.Fingerprint(), newReg("fingerprint secret", "192.0.2.2", 957).Fingerprint())
+	require.NotEqual(t, reg.Fingerprint(), newReg("fingerprint secret", "::ffff:192.0.2.2", 957).Fingerprint())
+	require.NotEqual(t, reg.Fingerprint(), newReg("fingerprint secret", "192.0.2.1", 958).Fingerprint())
+
+	// The fingerprint is used to deduplicate tracked registrations.
+	r := NewRegisteredDecoys()
+	r.transports[0] = mockTransport{}
+	require.Nil(t, r.Track(reg))
+	require.Nil(t, r.Track(same))
+	require.Equal(t, 1, r.TotalRegistrations())
+	require.Equal(t, reg, r.RegistrationExists(same))
+	require.Equal(t, int32(2), reg.regCount)
+}
+
+type recordingPublisher struct {
+	m      sync.Mutex
+	events []RegistrationEvent
+}
+
+func (p *recordingPublisher) Publish(event RegistrationEvent, encoding DetectorEncoding, payload []byte) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+func (p *recordingPublisher) count() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return len(p.events)
+}
+
+func TestRegistrationDeferDetectorPublish(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:               log.New(ioutil.Discard, "", 0),
+		registeredDecoys:     NewRegisteredDecoys(),
+		livenessLimiter:      newPhantomProbeLimiter(DefaultLivenessProbeInterval),
+		DeferDetectorPublish: true,
+		ProbeViaDecoy:        true,
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	publisher := &recordingPublisher{}
+	rm.SetDetectorPublisher(publisher)
+
+	// Phantoms at 192.0.2.1 answer probes, everything else never responds.
+	var probed int32
+	rm.DecoyProbeDialer = func(decoy net.IP, network, address string, timeout time.Duration) (net.Conn, error) {
+		atomic.AddInt32(&probed, 1)
+		if address == "192.0.2.1:443" {
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+		time.Sleep(2 * timeout)
+		return nil, fmt.Errorf("no response")
+	}
+
+	newReg := func(secret, phantom string) *DecoyRegistration {
+		return &DecoyRegistration{
+			DarkDecoy:        net.ParseIP(phantom),
+			PhantomPort:      443,
+			DecoyAddr:        net.ParseIP("198.51.100.7"),
+			Keys:             &ConjureSharedKeys{SharedSecret: []byte(secret)},
+			Covert:           "192.0.2.99:443",
+			RegistrationTime: time.Now(),
+		}
+	}
+
+	// The phantom is in use so the registration is never announced.
+	inUse := newReg("defer publish in use", "192.0.2.1")
+	err := rm.AddRegistration(inUse)
+	require.True(t, errors.Is(err, ErrPhantomInUse))
+	require.Equal(t, 0, publisher.count())
+	require.False(t, inUse.Valid)
+
+	// The phantom passes the liveness check and is published only after the probe.
+	unused := newReg("defer publish unused", "192.0.2.2")
+	probedBefore := atomic.LoadInt32(&probed)
+	require.Nil(t, rm.AddRegistration(unused))
+	require.NotEqual(t, probedBefore, atomic.LoadInt32(&probed))
+	require.Equal(t, 1, publisher.count())
+	require.True(t, unused.Valid)
+
+	// Without deferral the registration is published without a probe.
+	rm.DeferDetectorPublish = false
+	probedBefore = atomic.LoadInt32(&probed)
+	require.Nil(t, rm.AddRegistration(newReg("defer publish disabled", "192.0.2.3")))
+	require.Equal(t, probedBefore, atomic.LoadInt32(&probed))
+	require.Equal(t, 2, publisher.count())
+}
+
+func TestRegistrationBatchExpiryNotifications(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	publisher, err := NewFileEventPublisher(path)
+	require.Nil(t, err)
+	defer publisher.Close()
+
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	rm.SetDetectorPublisher(publisher)
+	rm.SetDetectorEncoding(DetectorEncodingJSON)
+
+	addExpired := func(prefix string) {
+		for i := 1; i <= 3; i++ {
+			reg := &DecoyRegistration{
+				DarkDecoy:        net.ParseIP(fmt.Sprintf("192.0.2.%d", i)),
+				PhantomPort:      443,
+				Keys:             &ConjureSharedKeys{SharedSecret: []byte(fmt.Sprintf("%d %s batch expiry", i, prefix))},
+				RegistrationTime: time.Now(),
+			}
+			require.Nil(t, rm.AddRegistration(reg))
+		}
+
+		// Backdate the registrations so that the next tick evicts them.
+		for _, timeout := range rm.registeredDecoys.decoysTimeouts {
+			timeout.registrationTime = time.Now().Add(-7 * time.Hour)
+		}
+	}
+
+	countLines := func(prefix string) []string {
+		var matched []string
+		for _, line := range readEventLines(t, path) {
+			if strings.HasPrefix(line, prefix+" ") {
+				matched = append(matched, line)
+			}
+		}
+		return matched
+	}
+
+	// Batching enabled: one message listing every expired phantom.
+	rm.SetBatchExpiryNotifications(true)
+	addExpired("enabled")
+	rm.RemoveOldRegistrations()
+
+	batches := countLines("expire-batch")
+	require.Equal(t, 1, len(batches))
+	require.Equal(t, 0, len(countLines("expire")))
+
+	var expired []detectorJSONPayload
+	require.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(batches[0], "expire-batch ")), &expired))
+	phantoms := []string{}
+	for _, e := range expired {
+		phantoms = append(phantoms, e.Phantom)
+	}
+	require.ElementsMatch(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, phantoms)
+
+	// Batching disabled: one message per expired registration.
+	rm.SetBatchExpiryNotifications(false)
+	addExpired("disabled")
+	rm.RemoveOldRegistrations()
+
+	require.Equal(t, 1, len(countLines("expire-batch")))
+	require.Equal(t, 3, len(countLines("expire")))
+}
+
+func TestRegistrationMigrateGeneration(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	rm.Logger = log.New(ioutil.Discard, "", 0)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+	publisher := &recordingPublisher{}
+	rm.SetDetectorPublisher(publisher)
+
+	oldGen := rm.PhantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.0.2.0/24"}}},
+	})
+	newGen := rm.PhantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"198.51.100.0/24"}}},
+	})
+
+	c2s, keys := mockReceiveFromDetector()
+	g := uint32(oldGen)
+	c2s.DecoyListGeneration = &g
+	regSource := pb.RegistrationSource_Detector
+	reg, err := rm.NewRegistration(&c2s, &keys, false, &regSource, nil)
+	require.Nil(t, err)
+	require.Nil(t, rm.AddRegistration(reg))
+
+	oldPhantom := reg.DarkDecoy
+	covert := reg.Covert
+	require.Equal(t, 1, len(rm.GetRegistrations(oldPhantom)))
+
+	_, err = rm.MigrateGeneration(oldGen, newGen+100)
+	require.NotNil(t, err)
+
+	migrated, err := rm.MigrateGeneration(oldGen, newGen)
+	require.Nil(t, err)
+	require.Equal(t, 1, migrated)
+
+	// The new phantom is the one the new generation selects for the same keys.
+	expected, err := rm.PhantomSelector.Select(keys.DarkDecoySeed, newGen, false)
+	require.Nil(t, err)
+	require.True(t, expected.Equal(reg.DarkDecoy))
+	require.Equal(t, "198.51.100.0/24", reg.PhantomSubnet)
+	require.Equal(t, uint32(newGen), reg.DecoyListVersion)
+	require.Equal(t, covert, reg.Covert)
+	require.Equal(t, &keys, reg.Keys)
+
+	require.Equal(t, 0, len(rm.GetRegistrations(oldPhantom)))
+	require.Equal(t, 1, len(rm.GetRegistrations(reg.DarkDecoy)))
+	require.Equal(t, 1, rm.registeredDecoys.TotalRegistrations())
+	require.True(t, rm.RegistrationExists(reg))
+
+	// The detector is told about the move.
+	require.Equal(t, []RegistrationEvent{EventRegister, EventExpire, EventRegister}, publisher.events)
+
+	// Nothing is left in the old generation.
+	migrated, err = rm.MigrateGeneration(oldGen, newGen)
+	require.Nil(t, err)
+	require.Equal(t, 0, migrated)
+
+	_, err = rm.MigrateGeneration(newGen, newGen)
+	require.NotNil(t, err)
+
+	// A registration with the same keys would land on the phantom and identifier
+	// already taken by the migrated one, so it is reported and left where it is.
+	dup := &DecoyRegistration{
+		DarkDecoy:        oldPhantom,
+		Keys:             &keys,
+		Covert:           covert,
+		DecoyListVersion: uint32(oldGen),
+	}
+	require.Nil(t, rm.AddRegistration(dup))
+	migrated, err = rm.MigrateGeneration(oldGen, newGen)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to migrate 1 registrations")
+	require.Equal(t, 0, migrated)
+	require.True(t, oldPhantom.Equal(dup.DarkDecoy))
+	require.Equal(t, uint32(oldGen), dup.DecoyListVersion)
+	require.Equal(t, 1, len(rm.GetRegistrations(oldPhantom)))
+	require.Equal(t, reg, rm.GetRegistrations(reg.DarkDecoy)[mockTransport{}.GetIdentifier(reg)])
+}
+
+func TestRegistrationTransportTimeouts(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	require.Nil(t, rm.AddTransport(pb.TransportType_Null, mockTransport{}))
+	require.Nil(t, rm.AddTransport(pb.TransportType_Min, mockTransport{}))
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	rm.SetTransportTimeout(pb.TransportType_Null, time.Hour)
+	rm.SetTransportTimeout(pb.TransportType_Min, 3*time.Hour)
+
+	short := &DecoyRegistration{
+		DarkDecoy: net.ParseIP("192.0.2.1"),
+		Keys:      &ConjureSharedKeys{SharedSecret: []byte("short transport timeout")},
+		Transport: pb.TransportType_Null,
+	}
+	long := &DecoyRegistration{
+		DarkDecoy: net.ParseIP("192.0.2.2"),
+		Keys:      &ConjureSharedKeys{SharedSecret: []byte("long transport timeout")},
+		Transport: pb.TransportType_Min,
+	}
+	require.Nil(t, rm.AddRegistration(short))
+	require.Nil(t, rm.AddRegistration(long))
+
+	age := func(d time.Duration) {
+		for _, timeout := range rm.registeredDecoys.decoysTimeouts {
+			timeout.registrationTime = time.Now().Add(-d)
+		}
+	}
+
+	// Just inside both boundaries nothing expires.
+	age(time.Hour - time.Minute)
+	rm.RemoveOldRegistrations()
+	require.True(t, rm.RegistrationExists(short))
+	require.True(t, rm.RegistrationExists(long))
+
+	// Past the short boundary only the short lived transport expires.
+	age(time.Hour + time.Minute)
+	rm.RemoveOldRegistrations()
+	require.False(t, rm.RegistrationExists(short))
+	require.True(t, rm.RegistrationExists(long))
+
+	age(3*time.Hour - time.Minute)
+	rm.RemoveOldRegistrations()
+	require.True(t, rm.RegistrationExists(long))
+
+	age(3*time.Hour + time.Minute)
+	rm.RemoveOldRegistrations()
+	require.False(t, rm.RegistrationExists(long))
+
+	// Clearing the override falls back to the default timeout.
+	rm.SetTransportTimeout(pb.TransportType_Min, 0)
+	require.Nil(t, rm.AddRegistration(long))
+	age(3*time.Hour + time.Minute)
+	rm.RemoveOldRegistrations()
+	require.True(t, rm.RegistrationExists(long))
+	age(regTimeout + time.Minute)
+	rm.RemoveOldRegistrations()
+	require.False(t, rm.RegistrationExists(long))
+}
+
+func TestRegistrationTimeout(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:              log.New(ioutil.Discard, "", 0),
+		registeredDecoys:    NewRegisteredDecoys(),
+		RegistrationTimeout: time.Second,
+	}
+	require.Nil(t, rm.AddTransport(pb.TransportType_Null, mockTransport{}))
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	reg := &DecoyRegistration{
+		DarkDecoy: net.ParseIP("192.0.2.1"),
+		Keys:      &ConjureSharedKeys{SharedSecret: []byte("one second timeout")},
+	}
+	require.Nil(t, rm.AddRegistration(reg))
+
+	rm.RemoveOldRegistrations()
+	require.True(t, rm.RegistrationExists(reg))
+
+	time.Sleep(time.Second + 100*time.Millisecond)
+	rm.RemoveOldRegistrations()
+	require.False(t, rm.RegistrationExists(reg))
+
+	// Zero keeps the default timeout.
+	rm.RegistrationTimeout = 0
+	require.Nil(t, rm.AddRegistration(reg))
+	time.Sleep(time.Second + 100*time.Millisecond)
+	rm.RemoveOldRegistrations()
+	require.True(t, rm.RegistrationExists(reg))
+}
+
+func TestRegistrationManagerRun(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:              log.New(ioutil.Discard, "", 0),
+		registeredDecoys:    NewRegisteredDecoys(),
+		RegistrationTimeout: 100 * time.Millisecond,
+	}
+	require.Nil(t, rm.AddTransport(pb.TransportType_Null, mockTransport{}))
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	reg := &DecoyRegistration{
+		DarkDecoy: net.ParseIP("192.0.2.1"),
+		Keys:      &ConjureSharedKeys{SharedSecret: []byte("background expiry")},
+	}
+	require.Nil(t, rm.AddRegistration(reg))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		rm.Run(ctx, 50*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rm.RegistrationExists(reg) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.False(t, rm.RegistrationExists(reg))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+}
+
+func TestRegistrationAltPhantom(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	rm.Logger = log.New(ioutil.Discard, "", 0)
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+	publisher := &recordingPublisher{}
+	rm.SetDetectorPublisher(publisher)
+
+	// The v6 subnet is so much larger that v6 clients are all but certain to select
+	// a v6 phantom.
+	gen := uint32(rm.PhantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.0.2.0/24", "2001:db8::/32"}}},
+	}))
+
+	c2s, keys := mockReceiveFromDetector()
+	c2s.DecoyListGeneration = &gen
+	c2s.V6Support = proto.Bool(true)
+	source := pb.RegistrationSource_Detector
+
+	// Without v6 support there is only the one v4 phantom.
+	reg, err := rm.NewRegistration(&c2s, &keys, false, &source, nil)
+	require.Nil(t, err)
+	require.NotNil(t, reg.DarkDecoy.To4())
+	require.Nil(t, reg.AltDarkDecoy)
+	require.NotContains(t, reg.String(), "AltPhantom")
+
+	reg, err = rm.NewRegistration(&c2s, &keys, true, &source, nil)
+	require.Nil(t, err)
+	require.Nil(t, reg.DarkDecoy.To4())
+	require.NotNil(t, reg.AltDarkDecoy.To4())
+	v4Phantom, err := rm.PhantomSelector.Select(keys.DarkDecoySeed, uint(gen), false)
+	require.Nil(t, err)
+	require.True(t, v4Phantom.Equal(reg.AltDarkDecoy))
+	require.Contains(t, reg.String(), reg.AltDarkDecoy.String())
+
+	require.Nil(t, rm.AddRegistration(reg))
+
+	// Connections to either phantom match, and both are shared with the detector.
+	require.Equal(t, reg, rm.GetRegistrations(reg.DarkDecoy)[mockTransport{}.GetIdentifier(reg)])
+	require.Equal(t, reg, rm.GetRegistrations(reg.AltDarkDecoy)[mockTransport{}.GetIdentifier(reg)])
+	require.Equal(t, 1, rm.CountRegistrations(reg.AltDarkDecoy))
+	require.Equal(t, 1, rm.registeredDecoys.TotalRegistrations())
+	require.Equal(t, []RegistrationEvent{EventRegister, EventRegister}, publisher.events)
+
+	require.True(t, rm.registeredDecoys.remove(reg))
+	require.Equal(t, 0, len(rm.GetRegistrations(reg.AltDarkDecoy)))
+	require.Equal(t, 0, len(rm.registeredDecoys.altDecoys))
+	require.Equal(t, []RegistrationEvent{EventRegister, EventRegister, EventExpire, EventExpire}, publisher.events)
+
+	// A generation with only v6 subnets has no fallback phantom, which is not
+	// counted as an empty pool.
+	v6Gen := uint32(rm.PhantomSelector.AddGeneration(-1, &SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"2001:db8::/32"}}},
+	}))
+	c2s.DecoyListGeneration = &v6Gen
+	reg, err = rm.NewRegistration(&c2s, &keys, true, &source, nil)
+	require.Nil(t, err)
+	require.Nil(t, reg.AltDarkDecoy)
+	require.Equal(t, int64(0), Stat().EmptyPoolSelections(uint(v6Gen)))
+}
+
+func TestRegistrationReplayAndCollision(t *testing.T) {
+	var logs bytes.Buffer
+	rm := &RegistrationManager{
+		Logger:           log.New(&logs, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	publisher := &recordingPublisher{}
+	rm.SetDetectorPublisher(publisher)
+
+	newReg := func(secret string) *DecoyRegistration {
+		return &DecoyRegistration{
+			DarkDecoy: net.ParseIP("192.0.2.1"),
+			Keys:      &ConjureSharedKeys{SharedSecret: []byte(secret)},
+		}
+	}
+
+	reg := newReg("replayed secret")
+	require.Nil(t, rm.AddRegistration(reg))
+	for _, timeout := range rm.registeredDecoys.decoysTimeouts {
+		timeout.registrationTime = time.Now().Add(-7 * time.Hour)
+	}
+
+	// Replaying the identical registration refreshes the existing entry instead of
+	// adding one, and it is not published again.
+	dups := atomic.LoadInt64(&Stat().newDupRegistrations)
+	require.Nil(t, rm.AddRegistration(newReg("replayed secret")))
+	require.Equal(t, dups+1, atomic.LoadInt64(&Stat().newDupRegistrations))
+	require.Equal(t, 1, rm.registeredDecoys.TotalRegistrations())
+	require.Equal(t, 1, len(rm.registeredDecoys.decoysTimeouts))
+	require.Equal(t, int32(2), reg.regCount)
+	require.Equal(t, []RegistrationEvent{EventRegister}, publisher.events)
+	require.NotContains(t, logs.String(), "collision")
+
+	rm.RemoveOldRegistrations()
+	require.True(t, rm.RegistrationExists(reg), "replay did not refresh the registration")
+
+	// A different secret that selected the same phantom is tracked separately but
+	// warned about.
+	other := newReg("colliding secret")
+	require.Nil(t, rm.AddRegistration(other))
+	require.Equal(t, 2, rm.registeredDecoys.TotalRegistrations())
+	require.Contains(t, logs.String(), "phantom selection collision: "+other.IDString())
+}
+
+func TestRegistrationStatusJSON(t *testing.T) {
+	rm := &RegistrationManager{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		registeredDecoys: NewRegisteredDecoys(),
+	}
+	rm.registeredDecoys.transports[0] = mockTransport{}
+	rm.SetDetectorPublisher(&recordingPublisher{})
+
+	tIL := true
+	var secrets [][]byte
+	for i := 0; i < 3; i++ {
+		secret := []byte(fmt.Sprintf("%d status secret %d", i, i))
+		secrets = append(secrets, secret)
+		keys, err := GenSharedKeys(secret)
+		require.Nil(t, err)
+		require.Nil(t, rm.TrackRegistration(&DecoyRegistration{
+			DarkDecoy: net.ParseIP(fmt.Sprintf("192.0.2.%d", i+1)),
+			Keys:      &keys,
+			Covert:    "192.0.2.200:443",
+			Mask:      "example.com",
+			Flags:     &pb.RegistrationFlags{Use_TIL: &tIL},
+		}))
+	}
+
+	snapshot := rm.registeredDecoys.Snapshot()
+	require.Equal(t, 3, len(snapshot))
+
+	// The snapshot is a copy; changing it does not change the tracked registrations.
+	snapshot[0].Covert = "changed"
+	for _, reg := range rm.registeredDecoys.Snapshot() {
+		require.Equal(t, "192.0.2.200:443", reg.Covert)
+	}
+
+	out, err := json.Marshal(snapshot)
+	require.Nil(t, err)
+	for _, secret := range secrets {
+		require.False(t, strings.Contains(string(out), hex.EncodeToString(secret)))
+		require.False(t, bytes.Contains(out, secret))
+	}
+
+	var statuses []RegistrationStatus
+	require.Nil(t, json.Unmarshal(out, &statuses))
+	require.Equal(t, 3, len(statuses))
+	for _, status := range statuses {
+		require.Equal(t, regIDLen, len(status.RegID))
+		require.NotEqual(t, "", status.Phantom)
+		require.Equal(t, "example.com", status.Mask)
+		require.Equal(t, "Null", status.Transport)
+
+		flags, err := hex.DecodeString(status.Flags)
+		require.Nil(t, err)
+		decoded := &pb.RegistrationFlags{}
+		require.Nil(t, proto.Unmarshal(flags, decoded))
+		require.True(t, decoded.GetUse_TIL())
+	}
+}
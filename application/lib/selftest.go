@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// selfTestCovert is the covert address used by self-test registrations. No
+// connection is ever made to it.
+const selfTestCovert = "192.0.2.1:443"
+
+// selfTestAttempts is the number of random secrets tried when creating the self-test
+// registration.
+const selfTestAttempts = 3
+
+// SelfTestStage is the outcome of a single stage of the registration self-test.
+type SelfTestStage struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// SelfTestReport is the outcome of RegistrationManager.SelfTest. Stages after the
+// first failure are not run and are not included.
+type SelfTestReport struct {
+	Passed bool            `json:"passed"`
+	Stages []SelfTestStage `json:"stages"`
+}
+
+func (r SelfTestReport) String() string {
+	stages := make([]string, len(r.Stages))
+	for i, stage := range r.Stages {
+		if stage.Passed {
+			stages[i] = fmt.Sprintf("%s: pass (%v)", stage.Name, stage.Duration)
+		} else {
+			stages[i] = fmt.Sprintf("%s: FAIL (%s)", stage.Name, stage.Error)
+		}
+	}
+
+	result := "FAIL"
+	if r.Passed {
+		result = "pass"
+	}
+	return fmt.Sprintf("self-test %s [%s]", result, strings.Join(stages, ", "))
+}
+
+// SelfTest exercises the full registration path for deployment validation: it
+// synthesizes a registration for a random secret in the newest phantom generation,
+// adds it as the station would a real registration, looks it up as a connection for
+// its phantom would, and evicts it. Finally, if the detector publisher implements
+// DetectorPinger, it checks that the detector can be reached. Each stage is reported
+// separately. The self-test registration is never published to the detector, since
+// the redis publisher does not share expiry, is not counted in the station stats or
+// passed to registration hooks and observers, and is always removed before SelfTest
+// returns.
+func (regManager *RegistrationManager) SelfTest(ctx context.Context) SelfTestReport {
+	report := SelfTestReport{Passed: true}
+
+	var reg *DecoyRegistration
+	evict := func() bool {
+		if !regManager.registeredDecoys.remove(reg) {
+			return false
+		}
+		regManager.notifyExpired(reg)
+		return true
+	}
+	defer func() {
+		if reg != nil {
+			evict()
+		}
+	}()
+
+	run := func(name string, stage func() error) bool {
+		start := time.Now()
+		err := ctx.Err()
+		if err == nil {
+			err = stage()
+		}
+
+		result := SelfTestStage{Name: name, Passed: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+			report.Passed = false
+		}
+		report.Stages = append(report.Stages, result)
+		return err == nil
+	}
+
+	var keys ConjureSharedKeys
+	var transport pb.TransportType
+	var identifier string
+
+	ok := run("new_registration", func() error {
+		t, tt, err := regManager.registeredDecoys.selfTestTransport()
+		if err != nil {
+			return err
+		}
+		transport = t
+
+		generation := uint32(regManager.PhantomSelector.newestGeneration())
+		covert := selfTestCovert
+		c2s := &pb.ClientToStation{
+			DecoyListGeneration: &generation,
+			CovertAddress:       &covert,
+			Transport:           &transport,
+		}
+		source := pb.RegistrationSource_Unspecified
+
+		// A small fraction of secrets can not select a phantom (as for real clients),
+		// so only fail if several random secrets in a row do not work.
+		for attempt := 0; attempt < selfTestAttempts; attempt++ {
+			secret := make([]byte, 32)
+			if _, err = rand.Read(secret); err != nil {
+				return err
+			}
+			keys, err = GenSharedKeys(secret)
+			if err != nil {
+				return err
+			}
+
+			reg, err = regManager.NewRegistration(c2s, &keys, false, &source, nil)
+			if err == nil {
+				reg.selfTest = true
+				identifier = tt.GetIdentifier(reg)
+				return nil
+			}
+		}
+		return err
+	})
+
+	if !ok {
+		return report
+	}
+
+	ok = run("add_registration", func() error {
+		return regManager.AddRegistration(reg)
+	})
+
+	if !ok {
+		return report
+	}
+
+	ok = run("lookup", func() error {
+		found, exists := regManager.GetRegistrations(reg.DarkDecoy)[identifier]
+		if !exists || found != reg {
+			return fmt.Errorf("registration not found for phantom %v", reg.DarkDecoy)
+		}
+		return nil
+	})
+
+	if !ok {
+		return report
+	}
+
+	ok = run("evict", func() error {
+		if !evict() {
+			return errors.New("registration was not tracked")
+		}
+		if regManager.RegistrationExists(reg) {
+			return errors.New("registration still tracked after eviction")
+		}
+		reg = nil
+		return nil
+	})
+
+	if !ok {
+		return report
+	}
+
+	run("detector_publisher", func() error {
+		regManager.registeredDecoys.m.RLock()
+		publisher := regManager.registeredDecoys.publisher
+		regManager.registeredDecoys.m.RUnlock()
+
+		if pinger, ok := publisher.(DetectorPinger); ok {
+			return pinger.Ping()
+		}
+		return nil
+	})
+
+	return report
+}
+
+// selfTestTransport returns the lowest numbered registered transport.
+func (r *RegisteredDecoys) selfTestTransport() (pb.TransportType, Transport, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	var found bool
+	var index pb.TransportType
+	for i := range r.transports {
+		if !found || i < index {
+			index = i
+			found = true
+		}
+	}
+	if !found {
+		return 0, nil, errors.New("no transports registered")
+	}
+	return index, r.transports[index], nil
+}
+
+// remove expires a single tracked registration immediately, returning false if it
+// was not tracked.
+func (r *RegisteredDecoys) remove(reg *DecoyRegistration) bool {
+	stats, _ := r.removeRegistration(reg.IDString()+reg.DarkDecoy.String(), nil)
+	return stats != nil
+}
+
+// newestGeneration returns the highest configured generation.
+func (p *PhantomIPSelector) newestGeneration() uint {
+	var newest uint
+	for gen := range p.Networks {
+		if gen > newest {
+			newest = gen
+		}
+	}
+	return newest
+}
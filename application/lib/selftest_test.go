@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pingPublisher is a recordingPublisher that can be pinged.
+type pingPublisher struct {
+	recordingPublisher
+	pings int
+	err   error
+}
+
+func (p *pingPublisher) Ping() error {
+	p.pings++
+	return p.err
+}
+
+func TestSelfTest(t *testing.T) {
+	os.Setenv("PHANTOM_SUBNET_LOCATION", "./test/phantom_subnets.toml")
+	rm, err := NewRegistrationManager()
+	require.Nil(t, err)
+	rm.Logger = log.New(ioutil.Discard, "", 0)
+	publisher := &recordingPublisher{}
+	rm.SetDetectorPublisher(publisher)
+
+	var registered, expired int
+	rm.OnRegister(func(*DecoyRegistration) { registered++ })
+	rm.OnExpire(func(*DecoyRegistration) { expired++ })
+
+	// Without a transport the self-test can not build a registration.
+	report := rm.SelfTest(context.Background())
+	require.False(t, report.Passed)
+	require.Equal(t, 1, len(report.Stages))
+	require.Equal(t, "new_registration", report.Stages[0].Name)
+	require.NotEmpty(t, report.Stages[0].Error)
+
+	require.Nil(t, rm.AddTransport(0, mockTransport{}))
+
+	active := atomic.LoadInt64(&Stat().activeRegistrations)
+	report = rm.SelfTest(context.Background())
+	require.True(t, report.Passed, report.String())
+
+	var names []string
+	for _, stage := range report.Stages {
+		require.True(t, stage.Passed)
+		names = append(names, stage.Name)
+	}
+	require.Equal(t, []string{"new_registration", "add_registration", "lookup", "evict", "detector_publisher"}, names)
+
+	// The registration was cleaned up without being shared with the detector.
+	require.Empty(t, publisher.events)
+
+	// Neither the hooks nor the station stats see the self-test registration.
+	require.Equal(t, 0, registered)
+	require.Equal(t, 0, expired)
+	require.Equal(t, active, atomic.LoadInt64(&Stat().activeRegistrations))
+	require.Equal(t, 0, rm.registeredDecoys.TotalRegistrations())
+	require.Equal(t, 0, len(rm.registeredDecoys.decoysTimeouts))
+
+	// A failing stage still leaves nothing behind.
+	rm.AcceptHooks = append(rm.AcceptHooks, func(*DecoyRegistration) error { return context.Canceled })
+	report = rm.SelfTest(context.Background())
+	require.False(t, report.Passed)
+	require.Equal(t, "add_registration", report.Stages[len(report.Stages)-1].Name)
+	require.Equal(t, 0, rm.registeredDecoys.TotalRegistrations())
+	rm.AcceptHooks = nil
+
+	// An unreachable detector fails the publisher stage without announcing anything.
+	pinger := &pingPublisher{err: errors.New("connection refused")}
+	rm.SetDetectorPublisher(pinger)
+	report = rm.SelfTest(context.Background())
+	require.False(t, report.Passed)
+	last := report.Stages[len(report.Stages)-1]
+	require.Equal(t, "detector_publisher", last.Name)
+	require.Equal(t, "connection refused", last.Error)
+	require.Equal(t, 1, pinger.pings)
+	require.Empty(t, pinger.events)
+	require.Equal(t, 0, rm.registeredDecoys.TotalRegistrations())
+
+	pinger.err = nil
+	report = rm.SelfTest(context.Background())
+	require.True(t, report.Passed, report.String())
+
+	// A cancelled context fails without running the stages.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report = rm.SelfTest(ctx)
+	require.False(t, report.Passed)
+	require.Equal(t, context.Canceled.Error(), report.Stages[0].Error)
+}
@@ -1,8 +1,11 @@
 package lib
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,9 +33,30 @@ type Stats struct {
 	newLivenessPass int64 // Liveness tests that passed (non-live phantom) since reset()
 	newLivenessFail int64 // Liveness tests that failed (live phantom) since reset()
 
+	vetoedRegistrations       int64 // Registrations rejected by an accept hook, not reset
+	backpressureRegistrations int64 // Registrations rejected because the registration table was full, not reset
+	rateLimitedRegistrations  int64 // Registrations rejected because the client exceeded its rate limit, not reset
+
+	droppedCallbacks int64 // Observer notifications dropped because the callback queue was full, not reset
+
+	idCollisions int64 // Registrations tracked with an id prefix already used by a different active secret, not reset
+
+	detectorPublishes      int64 // Events successfully published to the detector, not reset
+	detectorPublishErrors  int64 // Events that failed to publish to the detector, not reset
+	lastDetectorPublishErr int64 // Unix time in ns of the most recent failed publish, not reset
+
+	tickEvictions  int64 // Registrations evicted by the most recent expiry tick (evictions_per_tick), not reset
+	tickDurationNs int64 // Time the most recent expiry tick took to run (eviction_duration_seconds), not reset
+
 	genMutex    *sync.Mutex      // Lock for generations map
 	generations map[uint32]int64 // Map from ClientConf generation to number of registrations we saw using it
 
+	emptyPoolMutex *sync.Mutex    // Lock for emptyPools map
+	emptyPools     map[uint]int64 // Map from generation to number of selections that found no phantom addresses
+
+	subnetMutex *sync.Mutex      // Lock for subnets map
+	subnets     map[string]int64 // Map from configured phantom subnet to number of active registrations using it
+
 	newBytesUp   int64 // TODO: need to redo halfPipe to make this not really jumpy
 	newBytesDown int64 // ditto
 }
@@ -52,6 +76,11 @@ func initStats() {
 		logger:      logger,
 		generations: make(map[uint32]int64),
 		genMutex:    &sync.Mutex{},
+		subnets:     make(map[string]int64),
+		subnetMutex: &sync.Mutex{},
+
+		emptyPools:     make(map[uint]int64),
+		emptyPoolMutex: &sync.Mutex{},
 	}
 
 	// Periodic PrintStats()
@@ -83,7 +112,7 @@ func (s *Stats) Reset() {
 }
 
 func (s *Stats) PrintStats() {
-	s.logger.Printf("Conns: %d cur %d new %d err Regs: %d cur %d new (%d local %d API %d shared %d unknown) %d miss %d err %d dup LiveT: %d valid %d live Byte: %d up %d down",
+	s.logger.Printf("Conns: %d cur %d new %d err Regs: %d cur %d new (%d local %d API %d shared %d unknown) %d miss %d err %d dup LiveT: %d valid %d live Dropped: %d vetoed %d backpressure %d ratelimit %d callbacks %d idcollide Expiry: %d evicted %.3fs Byte: %d up %d down Subnets: %s",
 		atomic.LoadInt64(&s.activeConns), atomic.LoadInt64(&s.newConns), atomic.LoadInt64(&s.newErrConns),
 		atomic.LoadInt64(&s.activeRegistrations),
 		atomic.LoadInt64(&s.newRegistrations),
@@ -91,7 +120,11 @@ func (s *Stats) PrintStats() {
 		atomic.LoadInt64(&s.newMissedRegistrations),
 		atomic.LoadInt64(&s.newErrRegistrations), atomic.LoadInt64(&s.newDupRegistrations),
 		atomic.LoadInt64(&s.newLivenessPass), atomic.LoadInt64(&s.newLivenessFail),
-		atomic.LoadInt64(&s.newBytesUp), atomic.LoadInt64(&s.newBytesDown))
+		atomic.LoadInt64(&s.vetoedRegistrations), atomic.LoadInt64(&s.backpressureRegistrations), atomic.LoadInt64(&s.rateLimitedRegistrations),
+		atomic.LoadInt64(&s.droppedCallbacks), atomic.LoadInt64(&s.idCollisions),
+		atomic.LoadInt64(&s.tickEvictions), time.Duration(atomic.LoadInt64(&s.tickDurationNs)).Seconds(),
+		atomic.LoadInt64(&s.newBytesUp), atomic.LoadInt64(&s.newBytesDown),
+		formatSubnetCounts(s.ActiveRegistrationsBySubnet()))
 	s.Reset()
 }
 
@@ -109,7 +142,7 @@ func (s *Stats) ConnErr() {
 	atomic.AddInt64(&s.newErrConns, 1)
 }
 
-func (s *Stats) AddReg(generation uint32, source *pb.RegistrationSource) {
+func (s *Stats) AddReg(generation uint32, source *pb.RegistrationSource, subnet string) {
 	atomic.AddInt64(&s.activeRegistrations, 1)
 	atomic.AddInt64(&s.newRegistrations, 1)
 
@@ -129,6 +162,24 @@ func (s *Stats) AddReg(generation uint32, source *pb.RegistrationSource) {
 	s.genMutex.Lock()
 	s.generations[generation] += 1
 	s.genMutex.Unlock()
+
+	s.subnetMutex.Lock()
+	s.subnets[subnetLabel(subnet)] += 1
+	s.subnetMutex.Unlock()
+}
+
+// RestoreReg counts a registration restored from a snapshot as active, so that it is
+// balanced when it expires, without counting it as a new registration.
+func (s *Stats) RestoreReg(generation uint32, subnet string) {
+	atomic.AddInt64(&s.activeRegistrations, 1)
+
+	s.genMutex.Lock()
+	s.generations[generation] += 1
+	s.genMutex.Unlock()
+
+	s.subnetMutex.Lock()
+	s.subnets[subnetLabel(subnet)] += 1
+	s.subnetMutex.Unlock()
 }
 
 func (s *Stats) AddDupReg() {
@@ -139,7 +190,7 @@ func (s *Stats) AddErrReg() {
 	atomic.AddInt64(&s.newErrRegistrations, 1)
 }
 
-func (s *Stats) ExpireReg(generation uint32, source *pb.RegistrationSource) {
+func (s *Stats) ExpireReg(generation uint32, source *pb.RegistrationSource, subnet string) {
 	atomic.AddInt64(&s.activeRegistrations, -1)
 
 	/*
@@ -151,6 +202,79 @@ func (s *Stats) ExpireReg(generation uint32, source *pb.RegistrationSource) {
 	s.genMutex.Lock()
 	s.generations[generation] -= 1
 	s.genMutex.Unlock()
+
+	s.subnetMutex.Lock()
+	s.subnets[subnetLabel(subnet)] -= 1
+	s.subnetMutex.Unlock()
+}
+
+// ActiveRegistrationsBySubnet returns a copy of the active registration counts keyed
+// by the configured phantom subnet the registrations selected their phantom from.
+func (s *Stats) ActiveRegistrationsBySubnet() map[string]int64 {
+	s.subnetMutex.Lock()
+	defer s.subnetMutex.Unlock()
+
+	out := make(map[string]int64, len(s.subnets))
+	for k, v := range s.subnets {
+		out[k] = v
+	}
+	return out
+}
+
+// formatSubnetCounts formats active registrations per subnet for the stats line as
+// "subnet count" pairs sorted by subnet, skipping subnets with none.
+func formatSubnetCounts(counts map[string]int64) string {
+	subnets := make([]string, 0, len(counts))
+	for subnet, n := range counts {
+		if n != 0 {
+			subnets = append(subnets, subnet)
+		}
+	}
+	if len(subnets) == 0 {
+		return "none"
+	}
+	sort.Strings(subnets)
+
+	parts := make([]string, len(subnets))
+	for i, subnet := range subnets {
+		parts[i] = fmt.Sprintf("%s %d", subnet, counts[subnet])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// subnetLabel keeps subnet label cardinality bounded by the configured subnets.
+// Registrations that did not come through phantom selection share one label.
+func subnetLabel(subnet string) string {
+	if subnet == "" {
+		return "unknown"
+	}
+	return subnet
+}
+
+func (s *Stats) AddVetoedReg() {
+	atomic.AddInt64(&s.vetoedRegistrations, 1)
+}
+
+func (s *Stats) AddBackpressureReg() {
+	atomic.AddInt64(&s.backpressureRegistrations, 1)
+}
+
+func (s *Stats) AddRateLimitedReg() {
+	atomic.AddInt64(&s.rateLimitedRegistrations, 1)
+}
+
+// DetectorPublish records the outcome of publishing an event to the detector.
+func (s *Stats) DetectorPublish(err error) {
+	if err != nil {
+		atomic.AddInt64(&s.detectorPublishErrors, 1)
+		atomic.StoreInt64(&s.lastDetectorPublishErr, time.Now().UnixNano())
+		return
+	}
+	atomic.AddInt64(&s.detectorPublishes, 1)
+}
+
+func (s *Stats) AddDroppedCallback() {
+	atomic.AddInt64(&s.droppedCallbacks, 1)
 }
 
 func (s *Stats) AddMissedReg() {
@@ -165,6 +289,40 @@ func (s *Stats) AddLivenessFail() {
 	atomic.AddInt64(&s.newLivenessFail, 1)
 }
 
+// AddIDCollision records (and warns about) a newly tracked registration whose id prefix
+// collides with that of another active registration, making log correlation ambiguous.
+func (s *Stats) AddIDCollision(prefix string, secrets int) {
+	atomic.AddInt64(&s.idCollisions, 1)
+	s.logger.Printf("WARNING registration id prefix collision: %s shared by %d active secrets", prefix, secrets)
+}
+
+// AddEmptyPool records a phantom selection for a generation that had no addresses
+// to select from, warning the first time it happens for each generation.
+func (s *Stats) AddEmptyPool(generation uint) {
+	s.emptyPoolMutex.Lock()
+	defer s.emptyPoolMutex.Unlock()
+
+	s.emptyPools[generation]++
+	if s.emptyPools[generation] == 1 {
+		s.logger.Printf("WARNING phantom pool for generation %d is empty, all registrations for it will fail", generation)
+	}
+}
+
+// EmptyPoolSelections returns the number of selections for a generation that had no
+// phantom addresses to select from.
+func (s *Stats) EmptyPoolSelections(generation uint) int64 {
+	s.emptyPoolMutex.Lock()
+	defer s.emptyPoolMutex.Unlock()
+
+	return s.emptyPools[generation]
+}
+
+// ExpiryTick records the work done by a single run of the registration expiry loop.
+func (s *Stats) ExpiryTick(evicted int, duration time.Duration) {
+	atomic.StoreInt64(&s.tickEvictions, int64(evicted))
+	atomic.StoreInt64(&s.tickDurationNs, int64(duration))
+}
+
 func (s *Stats) AddBytesUp(n int64) {
 	atomic.AddInt64(&s.newBytesUp, n)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -18,6 +19,8 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	zmq "github.com/pebbe/zmq4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	cj "github.com/refraction-networking/conjure/application/lib"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
 
@@ -204,104 +207,16 @@ func get_zmq_updates(connectAddr string, regManager *cj.RegistrationManager, con
 					continue
 				}
 
-				if regManager.RegistrationExists(reg) {
-					// log phantom IP, shared secret, ipv6 support
-					logger.Printf("Duplicate registration: %v %s\n", reg.IDString(), reg.RegistrationSource)
-					cj.Stat().AddDupReg()
-
-					// Track the received registration, if it is already tracked it will just update the record
-					err := regManager.TrackRegistration(reg)
-					if err != nil {
-						logger.Println("error tracking registration: ", err)
-						cj.Stat().AddErrReg()
-					}
-					continue
-				}
-
-				// log phantom IP, shared secret, ipv6 support
-				logger.Printf("New registration: %s %v\n", reg.IDString(), reg.String())
-
-				// Track the received registration
-				err := regManager.TrackRegistration(reg)
+				err := regManager.IngestRegistration(context.Background(), reg, conf)
 				if err != nil {
-					logger.Println("error tracking registration: ", err)
-					cj.Stat().AddErrReg()
-				}
-
-				// If registration is trying to connect to a dark decoy that is blocklisted continue
-				if reg.Covert == "" || conf.IsBlocklisted(reg.Covert) {
-					logger.Printf("Dropping reg, malformed or blocklisted covert: %v, %s, %v", reg.IDString(), reg.Covert, err)
-					cj.Stat().AddErrReg()
-					continue
+					logger.Printf("Dropping registration %v -- %v\n", reg.IDString(), err)
 				}
-
-				if !reg.PreScanned() {
-					// New registration received over channel that requires liveness scan for the phantom
-					liveness, response := reg.PhantomIsLive()
-					if liveness == true {
-						logger.Printf("Dropping registration %v -- live phantom: %v\n", reg.IDString(), response)
-						cj.Stat().AddLivenessFail()
-						continue
-					}
-					cj.Stat().AddLivenessPass()
-				}
-
-				if conf.EnableShareOverAPI && *reg.RegistrationSource == pb.RegistrationSource_Detector {
-					// Registration received from decoy-registrar, share over API if enabled.
-					go tryShareRegistrationOverAPI(reg, conf.PreshareEndpoint)
-				}
-
-				if conf.IsBlocklistedPhantom(reg.DarkDecoy) {
-					// Note: Phantom blocklist is applied at this stage because the phantom may only be blocked on this
-					// station. We may want other stations to be informed about the registration, but prevent this station
-					// specifically from handling / interfering in any subsequent connection. See PR #75
-					logger.Printf("ignoring registration with blocklisted phantom: %s %v", reg.IDString(), reg.DarkDecoy)
-					continue
-				}
-
-				// validate the registration
-				regManager.AddRegistration(reg)
-				logger.Printf("Adding registration %v\n", reg.IDString())
-				cj.Stat().AddReg(reg.DecoyListVersion, reg.RegistrationSource)
 			}
 		}()
 
 	}
 }
 
-func tryShareRegistrationOverAPI(reg *cj.DecoyRegistration, apiEndpoint string) {
-	c2a := reg.GenerateC2SWrapper()
-
-	payload, err := proto.Marshal(c2a)
-	if err != nil {
-		logger.Printf("%v failed to marshal C2SWrapper payload: %v", reg.IDString(), err)
-		return
-	}
-
-	err = executeHTTPRequest(reg, payload, apiEndpoint)
-	if err != nil {
-		logger.Printf("%v failed to share Registration over API: %v", reg.IDString(), err)
-		return
-	}
-	return
-}
-
-func executeHTTPRequest(reg *cj.DecoyRegistration, payload []byte, apiEndpoint string) error {
-	resp, err := http.Post(apiEndpoint, "", bytes.NewReader(payload))
-	if err != nil {
-		logger.Printf("%v failed to do HTTP request to registration endpoint %s: %v", reg.IDString(), apiEndpoint, err)
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		logger.Printf("%v got non-success response code %d from registration endpoint %v", reg.IDString(), resp.StatusCode, apiEndpoint)
-		return fmt.Errorf("non-success response code %d on %s", resp.StatusCode, apiEndpoint)
-	}
-
-	return nil
-}
-
 // recieve_zmq_message  ingests messages from zmq and parses them into
 // registration structs for the registration manager to process.
 // **NOTE** : Avoid ALL blocking calls (i.e. things that require a lock on the
@@ -383,10 +298,21 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 	var err error
 	var zmqAddress string
+	var selfTest bool
 	flag.StringVar(&zmqAddress, "zmq-address", "ipc://@zmq-proxy", "Address of ZMQ proxy")
+	flag.BoolVar(&selfTest, "self-test", false, "Exercise the registration path against the configured station and exit")
 	flag.Parse()
 
-	regManager := cj.NewRegistrationManager()
+	// parse toml station configuration
+	conf, err := cj.ParseConfig()
+	if err != nil {
+		log.Fatalf("failed to parse app config: %v", err)
+	}
+
+	regManager, err := cj.NewRegistrationManagerWithRedis(conf.RedisConfig)
+	if err != nil {
+		log.Fatalf("failed to create registration manager: %v", err)
+	}
 	logger = regManager.Logger
 
 	// Should we log client IP addresses
@@ -399,12 +325,77 @@ func main() {
 	// Init stats
 	cj.Stat()
 
-	// parse toml station configuration
-	conf, err := cj.ParseConfig()
+	detectorEncoding, err := cj.ParseDetectorEncoding(conf.DetectorEncoding)
+	if err != nil {
+		logger.Fatalf("failed to parse app config: %v", err)
+	}
+	regManager.SetDetectorEncoding(detectorEncoding)
+
+	if conf.DetectorEventFile != "" {
+		eventFile, err := cj.NewFileEventPublisher(conf.DetectorEventFile)
+		if err != nil {
+			logger.Fatalf("failed to open detector event file: %v", err)
+		}
+		defer eventFile.Close()
+		regManager.SetDetectorPublisher(eventFile)
+	}
+	regManager.DeferDetectorPublish = conf.DeferDetectorPublish
+	regManager.SetBatchExpiryNotifications(conf.BatchExpiryNotifications)
+
+	regManager.RegistrationCodec, err = cj.ParseRegistrationCodec(conf.RegistrationCodec)
+	if err != nil {
+		logger.Fatalf("failed to parse app config: %v", err)
+	}
+
+	if conf.RegistrationKeyPath != "" {
+		key, err := ioutil.ReadFile(conf.RegistrationKeyPath)
+		if err != nil {
+			logger.Fatalf("failed to read registration key: %v", err)
+		}
+		regManager.RegistrationCodec, err = cj.NewEncryptedRegistrationCodec(regManager.RegistrationCodec, key)
+		if err != nil {
+			logger.Fatalf("failed to load registration key: %v", err)
+		}
+	}
+
+	regManager.V6SupportPolicy, err = cj.ParseV6SupportPolicy(conf.V6SupportPolicy)
 	if err != nil {
 		logger.Fatalf("failed to parse app config: %v", err)
 	}
 
+	regManager.SetMaxTrackedRegistrations(conf.MaxTrackedRegistrations)
+	regManager.SetRegistrationRateLimit(conf.RegistrationRateLimit, conf.RegistrationRateBurst)
+
+	err = regManager.SetTrustedSources(conf.TrustedSourceSubnets)
+	if err != nil {
+		logger.Fatalf("failed to parse app config: %v", err)
+	}
+
+	if conf.IDCollisionPrefixLen > 0 {
+		regManager.SetIDCollisionPrefixLen(conf.IDCollisionPrefixLen)
+	}
+
+	if conf.LivenessProbeInterval != nil {
+		regManager.SetLivenessProbeInterval(time.Duration(*conf.LivenessProbeInterval) * time.Millisecond)
+	}
+	regManager.SetLivenessCacheTTLs(time.Duration(conf.LivenessLiveTTL)*time.Millisecond,
+		time.Duration(conf.LivenessDeadTTL)*time.Millisecond)
+	err = regManager.SetLivenessProbePorts(conf.LivenessProbePorts)
+	if err != nil {
+		logger.Fatalf("failed to parse app config: %v", err)
+	}
+	regManager.SetLivenessProbeOptions(conf.LivenessProbeWidth,
+		time.Duration(conf.LivenessProbeTimeout)*time.Millisecond)
+
+	regManager.RegistrationTimeout = time.Duration(conf.RegistrationTimeout) * time.Millisecond
+	for name, timeout := range conf.TransportTimeouts {
+		transport, ok := pb.TransportType_value[name]
+		if !ok {
+			logger.Fatalf("failed to parse app config: unknown transport \"%s\" in transport_timeouts", name)
+		}
+		regManager.SetTransportTimeout(pb.TransportType(transport), time.Duration(timeout)*time.Millisecond)
+	}
+
 	// Launch local ZMQ proxy
 	go cj.ZMQProxy(conf.ZMQConfig)
 
@@ -418,16 +409,73 @@ func main() {
 		logger.Printf("failed to add transport: %v", err)
 	}
 
+	if selfTest {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		report := regManager.SelfTest(ctx)
+		cancel()
+
+		logger.Printf("[SELFTEST] %s", report)
+		if !report.Passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Restore registrations saved before the station restarted and keep saving them
+	if conf.RegistrationSnapshotPath != "" {
+		_, err = regManager.Load(conf.RegistrationSnapshotPath)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Printf("failed to restore registrations: %v", err)
+		}
+
+		interval := time.Minute
+		if conf.RegistrationSnapshotInterval > 0 {
+			interval = time.Duration(conf.RegistrationSnapshotInterval) * time.Millisecond
+		}
+		go regManager.SaveEvery(context.Background(), conf.RegistrationSnapshotPath, interval)
+	}
+
 	// Receive registration updates from ZMQ Proxy as subscriber
 	go get_zmq_updates(zmqAddress, regManager, conf)
 
-	// Periodically clean old registrations
-	go func() {
-		for {
-			time.Sleep(3 * time.Minute)
-			regManager.RemoveOldRegistrations()
+	// Optionally serve full registration digests over a restricted debug socket
+	debugSocket, err := cj.StartDebugSocket(conf.DebugSocketPath, regManager)
+	if err != nil {
+		logger.Printf("failed to start debug socket: %v", err)
+	} else if debugSocket != nil {
+		defer debugSocket.Close()
+	}
+
+	// Optionally accept registrations pushed from a separate ingest process
+	if conf.RegistrationRPCAddress != "" {
+		go func() {
+			err := cj.ServeRegistrationRPC(conf.RegistrationRPCAddress, regManager, conf)
+			if err != nil {
+				logger.Printf("registration rpc server failed: %v", err)
+			}
+		}()
+	}
+
+	// Optionally export registration metrics for Prometheus
+	if conf.MetricsAddress != "" {
+		registry := prometheus.NewRegistry()
+		err = regManager.RegisterMetrics(registry)
+		if err != nil {
+			logger.Fatalf("failed to register metrics: %v", err)
 		}
-	}()
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		go func() {
+			err := http.ListenAndServe(conf.MetricsAddress, mux)
+			if err != nil {
+				logger.Printf("metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	// Periodically clean old registrations
+	go regManager.Run(context.Background(), 3*time.Minute)
 
 	// listen for and handle incoming proxy traffic
 	listenAddr := &net.TCPAddr{IP: nil, Port: 41245, Zone: ""}
@@ -35,19 +35,20 @@ func TestManagerFunctionality(t *testing.T) {
 	testSubnetPath := os.Getenv("GOPATH") + "/src/github.com/refraction-networking/conjure/application/lib/test/phantom_subnets.toml"
 	os.Setenv("PHANTOM_SUBNET_LOCATION", testSubnetPath)
 
-	rm := dd.NewRegistrationManager()
+	rm, err := dd.NewRegistrationManager()
+	require.Nil(t, err)
 
 	c2s, keys := mockReceiveFromDetector()
 
 	transport := pb.TransportType_Min
 	gen := uint32(1)
-	err := rm.AddTransport(pb.TransportType_Min, min.Transport{})
+	err = rm.AddTransport(pb.TransportType_Min, min.Transport{})
 	require.Nil(t, err)
 	c2s.Transport = &transport
 	c2s.DecoyListGeneration = &gen
 
 	source := pb.RegistrationSource_Detector
-	newReg, err := rm.NewRegistration(c2s, &keys, c2s.GetV6Support(), &source)
+	newReg, err := rm.NewRegistration(c2s, &keys, c2s.GetV6Support(), &source, nil)
 	if err != nil {
 		t.Fatalf("Registration failed: %v", err)
 	}
@@ -53,7 +53,7 @@ func SetupPhantomConnections(manager *dd.RegistrationManager, transport pb.Trans
 	regType := pb.RegistrationSource_API
 	gen := uint32(1)
 	c2s := &pb.ClientToStation{Transport: &transport, CovertAddress: &covert, DecoyListGeneration: &gen}
-	reg, err = manager.NewRegistration(c2s, &keys, false, &regType)
+	reg, err = manager.NewRegistration(c2s, &keys, false, &regType, nil)
 	if err != nil {
 		log.Fatalln("failed to create new Registration:", err)
 	}
@@ -68,7 +68,10 @@ func SetupPhantomConnections(manager *dd.RegistrationManager, transport pb.Trans
 }
 
 func SetupRegistrationManager(transports ...Transport) *dd.RegistrationManager {
-	manager := dd.NewRegistrationManager()
+	manager, err := dd.NewRegistrationManager()
+	if err != nil {
+		log.Fatalln("failed to create registration manager:", err)
+	}
 	for _, t := range transports {
 		err := manager.AddTransport(t.Index, t.Transport)
 		if err != nil {